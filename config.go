@@ -13,23 +13,43 @@ import (
 )
 
 var (
-	Listen                       = ":8000"
-	DbName                       = ""
-	DbHost                       = "127.0.0.1"
-	DbPort                       = 5432
-	DbUser                       = "user"
-	DbPass                       = ""
-	Verbosity                    = 4
-	Secret                       = ""
-	Config                       = ""
-	CreateConf                   = false
-	Debug                        = true
-	Sentry                       = ""
-	UseSession                   = true
-	UseTransaction               = true
-	StatsD                       = ""
-	App                          = "acko"
-	FLAGSET        *flag.FlagSet = nil
+	Listen                                    = ":8000"
+	DbName                                    = ""
+	DbHost                                    = "127.0.0.1"
+	DbPort                                    = 5432
+	DbUser                                    = "user"
+	DbPass                                    = ""
+	Verbosity                                 = 4
+	Secret                                    = ""
+	Config                                    = ""
+	CreateConf                                = false
+	Debug                                     = true
+	Sentry                                    = ""
+	UseSession                                = true
+	UseTransaction                            = true
+	StatsD                                    = ""
+	App                                       = "acko"
+	SessionCookieName                         = "sessionid"
+	SessionCookieDomain                       = ""
+	SessionCookieSecure                       = false
+	SessionCookieHTTPOnly                     = true
+	SessionCookieSameSite                     = "Lax"
+	SessionCookieAge                          = 1209600
+	SessionExpireAtBrowserClose               = false
+	SessionSaveEveryRequest                   = false
+	LoginURL                                  = "/accounts/login/"
+	UseCSRF                                   = true
+	CSRFCookieName                            = "csrftoken"
+	CSRFCookieDomain                          = ""
+	CSRFCookieSecure                          = false
+	CSRFCookieHTTPOnly                        = false
+	CSRFCookieSameSite                        = "Lax"
+	CSRFCookieAge                             = 31449600
+	CSRFHeaderName                            = "X-CSRFToken"
+	CSRFTrustedOrigins                        = ""
+	CSRFUseSessions                           = false
+	SecureProxySSLHeader                      = ""
+	FLAGSET                     *flag.FlagSet = nil
 
 	Confs map[string]interface{}
 )
@@ -102,6 +122,94 @@ func init() {
 	StringFlag(&Sentry, "sentry", Sentry, "sentry endpoint")
 	StringFlag(&StatsD, "statsd", StatsD, "statsD endpoint")
 	StringFlag(&App, "app", App, "the app in use")
+
+	// these match django's SESSION_COOKIE_* settings and must have the same
+	// values as the django project sharing the sessions.
+	StringFlag(
+		&SessionCookieName, "session-cookie-name", SessionCookieName,
+		"SESSION_COOKIE_NAME",
+	)
+	StringFlag(
+		&SessionCookieDomain, "session-cookie-domain", SessionCookieDomain,
+		"SESSION_COOKIE_DOMAIN, empty for a host only cookie",
+	)
+	BoolFlag(
+		&SessionCookieSecure, "session-cookie-secure", SessionCookieSecure,
+		"SESSION_COOKIE_SECURE",
+	)
+	BoolFlag(
+		&SessionCookieHTTPOnly, "session-cookie-httponly",
+		SessionCookieHTTPOnly, "SESSION_COOKIE_HTTPONLY",
+	)
+	StringFlag(
+		&SessionCookieSameSite, "session-cookie-samesite",
+		SessionCookieSameSite,
+		"SESSION_COOKIE_SAMESITE, one of Lax, Strict, None or empty",
+	)
+	IntFlag(
+		&SessionCookieAge, "session-cookie-age", SessionCookieAge,
+		"SESSION_COOKIE_AGE in seconds",
+	)
+	BoolFlag(
+		&SessionExpireAtBrowserClose, "session-expire-at-browser-close",
+		SessionExpireAtBrowserClose, "SESSION_EXPIRE_AT_BROWSER_CLOSE",
+	)
+	BoolFlag(
+		&SessionSaveEveryRequest, "session-save-every-request",
+		SessionSaveEveryRequest, "SESSION_SAVE_EVERY_REQUEST",
+	)
+
+	StringFlag(
+		&LoginURL, "login-url", LoginURL,
+		"LOGIN_URL, where browsers are sent by LoginRequired and friends",
+	)
+
+	// and these match django's CSRF_* settings.
+	BoolFlag(
+		&UseCSRF, "csrf", UseCSRF,
+		"Should registered handlers check CSRF, except for requests authenticated by token or API key",
+	)
+	StringFlag(
+		&CSRFCookieName, "csrf-cookie-name", CSRFCookieName,
+		"CSRF_COOKIE_NAME",
+	)
+	StringFlag(
+		&CSRFCookieDomain, "csrf-cookie-domain", CSRFCookieDomain,
+		"CSRF_COOKIE_DOMAIN, empty for a host only cookie",
+	)
+	BoolFlag(
+		&CSRFCookieSecure, "csrf-cookie-secure", CSRFCookieSecure,
+		"CSRF_COOKIE_SECURE",
+	)
+	BoolFlag(
+		&CSRFCookieHTTPOnly, "csrf-cookie-httponly", CSRFCookieHTTPOnly,
+		"CSRF_COOKIE_HTTPONLY",
+	)
+	StringFlag(
+		&CSRFCookieSameSite, "csrf-cookie-samesite", CSRFCookieSameSite,
+		"CSRF_COOKIE_SAMESITE, one of Lax, Strict, None or empty",
+	)
+	IntFlag(
+		&CSRFCookieAge, "csrf-cookie-age", CSRFCookieAge,
+		"CSRF_COOKIE_AGE in seconds",
+	)
+	StringFlag(
+		&CSRFHeaderName, "csrf-header-name", CSRFHeaderName,
+		"header carrying the token, CSRF_HEADER_NAME without HTTP_",
+	)
+	StringFlag(
+		&CSRFTrustedOrigins, "csrf-trusted-origins", CSRFTrustedOrigins,
+		"comma separated CSRF_TRUSTED_ORIGINS, like https://*.example.com",
+	)
+	BoolFlag(
+		&CSRFUseSessions, "csrf-use-sessions", CSRFUseSessions,
+		"CSRF_USE_SESSIONS",
+	)
+	StringFlag(
+		&SecureProxySSLHeader, "secure-proxy-ssl-header", SecureProxySSLHeader,
+		"SECURE_PROXY_SSL_HEADER as header:value, like X-Forwarded-Proto:https. "+
+			"Only set it behind a proxy that sets the header, empty trusts only TLS",
+	)
 }
 
 func Init() {
@@ -1,6 +1,8 @@
 package amalgam
 
 import (
+	crand "crypto/rand"
+	"math/big"
 	"math/rand"
 )
 
@@ -17,3 +19,35 @@ func GetRandomString(size int) string {
 	}
 	return string(b)
 }
+
+// GetSecureRandomString is like GetRandomString but uses crypto/rand, use it
+// for salts, keys and tokens. It panics if the system random source fails.
+func GetSecureRandomString(size int) string {
+	array := append(LETTERS, DIGITS...)
+	max := big.NewInt(int64(len(array)))
+	b := make([]byte, size)
+	for i := range b {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = array[n.Int64()]
+	}
+	return string(b)
+}
+
+// GetSecureRandomDigits returns size random decimal digits from crypto/rand,
+// for codes sent by SMS and the like. It panics if the system random source
+// fails.
+func GetSecureRandomDigits(size int) string {
+	max := big.NewInt(int64(len(DIGITS)))
+	b := make([]byte, size)
+	for i := range b {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = DIGITS[n.Int64()]
+	}
+	return string(b)
+}
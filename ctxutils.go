@@ -10,7 +10,8 @@ import (
 )
 
 const (
-	KeyWG = "wg"
+	KeyWG          = "wg"
+	KeyCommitHooks = "commit-hooks"
 )
 
 func GetContext() (context.Context, error) {
@@ -43,3 +44,44 @@ func GetContext() (context.Context, error) {
 
 	return ctx, nil
 }
+
+// CommitHooks are functions to run once the transaction in the context
+// commits, like django's transaction.on_commit().
+type CommitHooks struct {
+	sync.Mutex
+	fns []func()
+}
+
+// WithCommitHooks returns a context OnCommit() adds hooks to. Whoever commits
+// the transaction calls Run() on the returned hooks afterwards, and drops them
+// on rollback.
+func WithCommitHooks(ctx context.Context) (context.Context, *CommitHooks) {
+	hooks := &CommitHooks{}
+	return context.WithValue(ctx, KeyCommitHooks, hooks), hooks
+}
+
+// Run calls the hooks in the order they were added, once.
+func (h *CommitHooks) Run() {
+	h.Lock()
+	fns := h.fns
+	h.fns = nil
+	h.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// OnCommit runs fn after the transaction in ctx commits. Without
+// WithCommitHooks() in ctx fn runs right away.
+func OnCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(KeyCommitHooks).(*CommitHooks)
+	if !ok {
+		fn()
+		return
+	}
+
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.fns = append(hooks.fns, fn)
+}
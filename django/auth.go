@@ -1,6 +1,48 @@
 package django
 
-import "context"
+import (
+	"context"
+
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrInvalidCredentials is returned by UserStore.Authenticate() when the
+	// user does not exist, the password is wrong or the user is inactive.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrConflict is returned by User.Save() when the user was changed or
+	// deleted by someone else since it was loaded.
+	ErrConflict = errors.New("user changed concurrently")
+)
+
+// KeyActor is the context key of the user making changes, who is recorded as
+// the user of django_admin_log entries. The value is a User or an ActorFunc.
+// Users are not saved without an actor, changes made outside of requests, or
+// by anonymous requests like password resets, need WithActor(), say with a
+// system user or with the user themselves.
+const KeyActor = "django-actor"
+
+// ActorFunc finds the actor when it is first needed, the http middleware uses
+// it to authenticate the request user lazily.
+type ActorFunc func(context.Context) (User, error)
+
+// WithActor returns a copy of ctx with user as the actor, for changes made
+// outside of requests.
+func WithActor(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, KeyActor, user)
+}
+
+// Ctx2Actor returns the actor of ctx, or ErrNoUser if there is none.
+func Ctx2Actor(ctx context.Context) (User, error) {
+	switch actor := ctx.Value(KeyActor).(type) {
+	case User:
+		return actor, nil
+	case ActorFunc:
+		user, err := actor(ctx)
+		return user, errors.Trace(err)
+	}
+	return nil, errors.Trace(ErrNoUser)
+}
 
 type User interface {
 	ID() int64
@@ -8,16 +50,30 @@ type User interface {
 	Email() string
 	CheckPassword(string) bool
 
+	// Roles() returns the names of the groups of the user. Like django's
+	// permission cache, groups and permissions are read once per loaded user
+	// for Roles(), HasRole(), Permissions() and HasPermission(), changes made
+	// with GroupStore or PermissionStore afterwards show after
+	// RefreshFromDB().
 	Roles() ([]string, error)
+	// Permissions() returns the permissions of the user and of their groups,
+	// all permissions for superusers and none for inactive users.
 	Permissions() ([]Permission, error)
+	// HasRole() returns true if the user is in the group with the id.
 	HasRole(context.Context, int64) (bool, error)
+	// HasPermission() takes a permission as "app_label.codename", like
+	// django's User.has_perm().
 	HasPermission(string) (bool, error)
 
 	SetName(string, bool) error
 	SetEmail(string, bool) error
 	SetPassword(string, bool) error
 	Save(context.Context) error
+	// RefreshFromDB() reloads the user and drops the cached groups and
+	// permissions.
 	RefreshFromDB(context.Context) error
+	// UpdateLastLogin() sets last_login to now and saves just that field.
+	UpdateLastLogin(context.Context) error
 	Deactivate(reason string) error
 
 	IsSuperUser() bool
@@ -27,11 +83,19 @@ type UserStore interface {
 	GetOrCreateUser(context.Context, map[string]interface{}) (User, error)
 	UserByID(context.Context, int64) (User, error)
 	UserByAPIKey(context.Context, string) (User, error)
+	// UserByToken() returns the owner of a django rest framework auth token.
+	UserByToken(context.Context, string) (User, error)
 	UserByPhone(context.Context, string) (User, error)
 	UserByEmail(context.Context, string) (User, error)
 	Authenticate(context.Context, string, string) (User, error)
 }
 
+// UserFields is implemented by user stores that can tell which fields their
+// user model has, so callers only pass GetOrCreateUser() details it can store.
+type UserFields interface {
+	HasUserField(name string) bool
+}
+
 type Group interface {
 	ID() int64
 	Name() string
@@ -42,18 +106,50 @@ type GroupStore interface {
 	Groups(context.Context) ([]Group, error)
 	GroupByID(context.Context, int64) (Group, error)
 	GroupByName(context.Context, string) (Group, error)
+
+	CreateGroup(ctx context.Context, name string) (Group, error)
+	// RenameGroup() returns sql.ErrNoRows if there is no such group.
+	RenameGroup(ctx context.Context, groupID int64, name string) error
+	// AddUserToGroup() and the other methods changing memberships and grants
+	// do nothing if the change was already made, like django's related
+	// managers. Users loaded before the change do not see it, see
+	// User.Roles().
+	AddUserToGroup(ctx context.Context, userID, groupID int64) error
+	RemoveUserFromGroup(ctx context.Context, userID, groupID int64) error
+	GrantGroupPermission(ctx context.Context, groupID, permissionID int64) error
+	RevokeGroupPermission(ctx context.Context, groupID, permissionID int64) error
 }
 
 type Permission interface {
 	ID() int64
+	// Code() is the codename of the permission, without the app label.
 	Code() string
 	Name() string
+	// AppLabel() is the app label of the content type of the permission.
+	AppLabel() string
+}
+
+// PermissionString returns perm as "app_label.codename", the way django names
+// permissions in has_perm().
+func PermissionString(perm Permission) string {
+	return perm.AppLabel() + "." + perm.Code()
 }
 
 type PermissionStore interface {
 	Permissions(context.Context) ([]Permission, error)
 	PermissionByID(context.Context, int64) (Permission, error)
 	PermissionByCode(context.Context, string) (Permission, error)
+
+	GrantUserPermission(ctx context.Context, userID, permissionID int64) error
+	RevokeUserPermission(ctx context.Context, userID, permissionID int64) error
+	// EnsurePermissions() creates the content type appLabel.model and the
+	// permissions in names, which maps codenames to names, unless they exist,
+	// like django's post_migrate handler. If names is empty django's default
+	// add, change, delete and view permissions are made. It returns all
+	// permissions of the content type.
+	EnsurePermissions(
+		ctx context.Context, appLabel, model string, names map[string]string,
+	) ([]Permission, error)
 }
 
 type AuthStore interface {
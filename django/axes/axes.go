@@ -0,0 +1,433 @@
+// Package axes tracks failed logins in the axes_accessattempt and
+// axes_accesslog tables of django-axes, so users locked out by the django
+// admin are locked out here too and the other way round.
+package axes
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// ErrLockedOut is returned by Store.Authenticate() when there were too many
+// failed attempts.
+var ErrLockedOut = errors.New("locked out, too many failed login attempts")
+
+// LockoutBy selects what failed attempts are counted against, like
+// AXES_LOCKOUT_PARAMETERS.
+type LockoutBy int
+
+const (
+	// ByIP counts failures from the same IP, whatever the username.
+	ByIP LockoutBy = iota
+	// ByUsername counts failures for the same username, from any IP.
+	ByUsername
+	// ByUsernameAndIP counts failures for the same username from the same IP.
+	ByUsernameAndIP
+)
+
+// Options configure a Store created by NewCustomStore.
+type Options struct {
+	// AttemptTable and LogTable default to the tables of django-axes.
+	AttemptTable string
+	LogTable     string
+	// FailureLimit is AXES_FAILURE_LIMIT, defaults to 3.
+	FailureLimit int
+	// CoolOff is AXES_COOLOFF_TIME, failures older than it are forgotten. Zero
+	// keeps them until they are reset.
+	CoolOff   time.Duration
+	LockoutBy LockoutBy
+	// ResetOnSuccess is AXES_RESET_ON_SUCCESS.
+	ResetOnSuccess bool
+	// DisableAccessLog is AXES_DISABLE_ACCESS_LOG.
+	DisableAccessLog bool
+	// NoSessionHash must be set for django-axes before 6.0, its
+	// axes_accesslog has no session_hash column.
+	NoSessionHash bool
+	// UsernameField is AXES_USERNAME_FORM_FIELD, defaults to "username".
+	UsernameField string
+}
+
+func updateOptionsWithDefault(o *Options) {
+	if o.AttemptTable == "" {
+		o.AttemptTable = "axes_accessattempt"
+	}
+	if o.LogTable == "" {
+		o.LogTable = "axes_accesslog"
+	}
+	if o.FailureLimit == 0 {
+		o.FailureLimit = 3
+	}
+	if o.UsernameField == "" {
+		o.UsernameField = "username"
+	}
+}
+
+// Store records login attempts. Like django-axes it writes outside the request
+// transaction, so failures are counted even if the request is rolled back.
+type Store interface {
+	// IsLocked() returns true if username, from the IP of r, is locked out.
+	IsLocked(ctx context.Context, r *http.Request, username string) (bool, error)
+	// IsRequestLocked() is IsLocked() with the username in the
+	// Options.UsernameField form field of r.
+	IsRequestLocked(ctx context.Context, r *http.Request) (bool, error)
+	// RecordFailure() counts a failed login, like axes' user_login_failed
+	// handler.
+	RecordFailure(ctx context.Context, r *http.Request, username string) error
+	// RecordSuccess() writes the access log and, with ResetOnSuccess, forgets
+	// the failures, like axes' user_logged_in handler.
+	RecordSuccess(ctx context.Context, r *http.Request, username string) error
+	// Authenticate() calls users.Authenticate() unless username is locked out
+	// and records the result. ErrLockedOut is returned if username was or
+	// now is locked out.
+	Authenticate(
+		ctx context.Context, r *http.Request, users django.UserStore,
+		username, password string,
+	) (django.User, error)
+	// Reset() deletes the attempts of ip and username, like axes' reset(),
+	// an empty ip or username matches all. It returns how many were deleted.
+	Reset(ctx context.Context, ip, username string) (int64, error)
+}
+
+// NewCustomStore creates a Store.
+func NewCustomStore(options Options) Store {
+	updateOptionsWithDefault(&options)
+	return &store{options}
+}
+
+// NewStore creates a Store with default Options, which lock out an IP after
+// three failures until it is reset.
+func NewStore() Store {
+	return NewCustomStore(Options{})
+}
+
+type store struct {
+	Options
+}
+
+// client is what axes reads from a request.
+type client struct {
+	ip        sql.NullString
+	username  string
+	userAgent string
+	accept    string
+	path      string
+}
+
+func newClient(r *http.Request, username string) (*client, error) {
+	c := &client{
+		username:  truncate(username, 255),
+		userAgent: truncate(r.UserAgent(), 255),
+		accept:    truncate(r.Header.Get("Accept"), 1025),
+		path:      truncate(r.URL.Path, 255),
+	}
+
+	ip, err := amalgam.GetIPFromRequest(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.ip = sql.NullString{String: ip, Valid: ip != ""}
+
+	return c, nil
+}
+
+// truncate cuts s to the max_length of its column, which counts runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// filter returns the WHERE clause matching the attempts of c, it starts at
+// placeholder $n. Attempts without an IP are stored as NULL, which "=" never
+// matches, so IPs are compared with IS NOT DISTINCT FROM.
+func (s *store) filter(c *client, n int) (string, []interface{}) {
+	ip := "ip_address IS NOT DISTINCT FROM $" + strconv.Itoa(n)
+	username := "username = $" + strconv.Itoa(n)
+
+	switch s.LockoutBy {
+	case ByUsername:
+		return username, []interface{}{c.username}
+	case ByUsernameAndIP:
+		return username + " AND ip_address IS NOT DISTINCT FROM $" +
+				strconv.Itoa(n+1),
+			[]interface{}{c.username, c.ip}
+	default:
+		return ip, []interface{}{c.ip}
+	}
+}
+
+func (s *store) failures(ctx context.Context, c *client) (int, error) {
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	where, args := s.filter(c, 1)
+	if s.CoolOff > 0 {
+		where += " AND attempt_time >= $" + strconv.Itoa(len(args)+1)
+		args = append(args, time.Now().Add(-s.CoolOff))
+	}
+
+	var failures sql.NullInt64
+	err = db.QueryRow(
+		"SELECT MAX(failures_since_start) FROM "+s.AttemptTable+
+			" WHERE "+where,
+		args...,
+	).Scan(&failures)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return int(failures.Int64), nil
+}
+
+func (s *store) locked(ctx context.Context, c *client) (bool, error) {
+	if s.LockoutBy != ByIP && c.username == "" {
+		return false, nil
+	}
+
+	failures, err := s.failures(ctx, c)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return failures >= s.FailureLimit, nil
+}
+
+func (s *store) IsLocked(
+	ctx context.Context, r *http.Request, username string,
+) (bool, error) {
+	c, err := newClient(r, username)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	locked, err := s.locked(ctx, c)
+	return locked, errors.Trace(err)
+}
+
+func (s *store) IsRequestLocked(
+	ctx context.Context, r *http.Request,
+) (bool, error) {
+	locked, err := s.IsLocked(ctx, r, r.FormValue(s.UsernameField))
+	return locked, errors.Trace(err)
+}
+
+// cleanExpired is axes' clean_expired_user_attempts().
+func (s *store) cleanExpired(ctx context.Context) error {
+	if s.CoolOff <= 0 {
+		return nil
+	}
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = db.Exec(
+		"DELETE FROM "+s.AttemptTable+" WHERE attempt_time < $1",
+		time.Now().Add(-s.CoolOff),
+	)
+	return errors.Trace(err)
+}
+
+func (s *store) RecordFailure(
+	ctx context.Context, r *http.Request, username string,
+) error {
+	c, err := newClient(r, username)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.cleanExpired(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	// one row per username, ip and user agent, like axes.
+	now := time.Now()
+	result, err := db.Exec(
+		`
+			UPDATE `+s.AttemptTable+` SET
+				failures_since_start = failures_since_start + 1,
+				attempt_time = $1, http_accept = $2, path_info = $3
+			WHERE username = $4 AND ip_address IS NOT DISTINCT FROM $5
+				AND user_agent = $6
+		`,
+		now, c.accept, c.path, c.username, c.ip, c.userAgent,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rows == 0 {
+		_, err = db.Exec(
+			`
+				INSERT INTO `+s.AttemptTable+` (
+					user_agent, ip_address, username, http_accept, path_info,
+					attempt_time, get_data, post_data, failures_since_start
+				) VALUES ($1, $2, $3, $4, $5, $6, $7, '', 1)
+			`,
+			c.userAgent, c.ip, c.username, c.accept, c.path, now,
+			r.URL.RawQuery,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	amalgam.LOGGER.Info(
+		"axes_login_failed", "username", c.username, "ip", c.ip.String,
+	)
+	amalgam.Counter("axes_login_failed", 1, 1)
+	return nil
+}
+
+func (s *store) RecordSuccess(
+	ctx context.Context, r *http.Request, username string,
+) error {
+	c, err := newClient(r, username)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.cleanExpired(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !s.DisableAccessLog {
+		columns := "user_agent, ip_address, username, http_accept, " +
+			"path_info, attempt_time"
+		values := "$1, $2, $3, $4, $5, $6"
+		if !s.NoSessionHash {
+			columns += ", session_hash"
+			values += ", ''"
+		}
+
+		_, err = db.Exec(
+			"INSERT INTO "+s.LogTable+" ("+columns+") VALUES ("+values+")",
+			c.userAgent, c.ip, c.username, c.accept, c.path, time.Now(),
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if s.ResetOnSuccess {
+		where, args := s.filter(c, 1)
+		_, err = db.Exec("DELETE FROM "+s.AttemptTable+" WHERE "+where, args...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *store) Authenticate(
+	ctx context.Context, r *http.Request, users django.UserStore,
+	username, password string,
+) (django.User, error) {
+	c, err := newClient(r, username)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	locked, err := s.locked(ctx, c)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if locked {
+		amalgam.LOGGER.Info(
+			"axes_locked_out", "username", c.username, "ip", c.ip.String,
+		)
+		return nil, errors.Trace(ErrLockedOut)
+	}
+
+	user, err := users.Authenticate(ctx, username, password)
+	if err != nil {
+		if errors.Cause(err) != django.ErrInvalidCredentials {
+			return nil, errors.Trace(err)
+		}
+
+		if err := s.RecordFailure(ctx, r, username); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// the attempt that reaches the limit is locked out already.
+		locked, lerr := s.locked(ctx, c)
+		if lerr != nil {
+			return nil, errors.Trace(lerr)
+		}
+		if locked {
+			return nil, errors.Trace(ErrLockedOut)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	if err := s.RecordSuccess(ctx, r, username); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return user, nil
+}
+
+func (s *store) Reset(ctx context.Context, ip, username string) (int64, error) {
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if ip != "" {
+		args = append(args, ip)
+		where = append(
+			where, "ip_address IS NOT DISTINCT FROM $"+strconv.Itoa(len(args)),
+		)
+	}
+	if username != "" {
+		args = append(args, username)
+		where = append(where, "username = $"+strconv.Itoa(len(args)))
+	}
+
+	result, err := db.Exec(
+		"DELETE FROM "+s.AttemptTable+" WHERE "+strings.Join(where, " AND "),
+		args...,
+	)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	amalgam.LOGGER.Info(
+		"axes_reset", "ip", ip, "username", username, "attempts", rows,
+	)
+	return rows, nil
+}
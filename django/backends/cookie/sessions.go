@@ -0,0 +1,235 @@
+// Package cookie is the equivalent of django's signed_cookies session backend.
+// The whole session is serialized and signed into the session key, which is
+// stored in the cookie, so no database is needed.
+package cookie
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/signing"
+	"github.com/juju/errors"
+)
+
+// Salt is what django's signed_cookies backend signs sessions with.
+const Salt = "django.contrib.sessions.backends.signed_cookies"
+
+// SessionOptions configure a session store created by NewCustomSessionStore.
+type SessionOptions struct {
+	Secret string
+	// SecretFallbacks are accepted in addition to Secret when verifying
+	// cookies, like django's SECRET_KEY_FALLBACKS.
+	SecretFallbacks []string
+	// CookieAge is django's SESSION_COOKIE_AGE, cookies signed longer ago are
+	// treated as empty sessions. Defaults to amalgam.SessionCookieAge.
+	CookieAge time.Duration
+}
+
+func updateSessionOptionsWithDefault(so *SessionOptions) {
+	if so.CookieAge == 0 {
+		so.CookieAge = time.Second * time.Duration(amalgam.SessionCookieAge)
+	}
+}
+
+// NewCustomSessionStore creates a signed cookie session store.
+func NewCustomSessionStore(
+	auth django.AuthStore, options SessionOptions,
+) django.SessionStore {
+	updateSessionOptionsWithDefault(&options)
+	return &store{auth: auth, options: options}
+}
+
+// NewSessionStore creates a signed cookie session store with default
+// SessionOptions.
+func NewSessionStore(secret string, auth django.AuthStore) django.SessionStore {
+	return NewCustomSessionStore(auth, SessionOptions{Secret: secret})
+}
+
+type store struct {
+	auth    django.AuthStore
+	options SessionOptions
+}
+
+func (s *store) signer() *signing.TimestampSigner {
+	return &signing.TimestampSigner{Signer: signing.Signer{
+		Key: s.options.Secret, FallbackKeys: s.options.SecretFallbacks,
+		Salt: Salt,
+	}}
+}
+
+// GetSessionBySessionKey decodes the session from key. Like django, a key that
+// fails verification or is older than CookieAge gives an empty session. With
+// amalgam.SessionSaveEveryRequest the session is signed again, so the new
+// timestamp pushes back its expiry.
+func (s *store) GetSessionBySessionKey(
+	ctx context.Context, key string,
+) (django.Session, error) {
+	ss := &session{store: s, key: key}
+
+	err := s.signer().UnsignObject(key, &ss.data, s.options.CookieAge)
+	if err != nil {
+		cause := errors.Cause(err)
+		if cause != signing.ErrBadSignature && cause != signing.ErrSignatureExpired {
+			return nil, errors.Trace(err)
+		}
+
+		if cause == signing.ErrBadSignature {
+			amalgam.LOGGER.Warn("session_cookie_tampered", "err", err)
+			amalgam.Counter("session_data_tampered", 1, 1)
+		}
+		return s.CreateSession(ctx)
+	}
+	if ss.data == nil {
+		ss.data = make(map[string]json.RawMessage)
+	}
+
+	if amalgam.SessionSaveEveryRequest && len(ss.data) != 0 {
+		if err := ss.sign(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return ss, nil
+}
+
+// CreateSession returns an empty session, it has no key until a value is set,
+// so no cookie is sent for sessions that are never written to.
+func (s *store) CreateSession(_ context.Context) (django.Session, error) {
+	return &session{store: s, data: make(map[string]json.RawMessage)}, nil
+}
+
+// DestroySession does nothing, the client drops the cookie when the session is
+// destroyed with Session.Destroy().
+func (s *store) DestroySession(context.Context, string) error {
+	return nil
+}
+
+// ClearExpired does nothing, expired cookies are rejected when they are read.
+func (s *store) ClearExpired(context.Context) (int64, error) {
+	return 0, nil
+}
+
+type session struct {
+	store *store
+	key   string
+	data  map[string]json.RawMessage
+}
+
+// sign recomputes the session key from data, like django's _get_session_key().
+func (s *session) sign() error {
+	key, err := s.store.signer().SignObject(s.data, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.key = key
+	return nil
+}
+
+func (s *session) SessionKey() string {
+	return s.key
+}
+
+// SetValue changes the session key, the new key has to be sent to the client
+// in the session cookie.
+func (s *session) SetValue(_ context.Context, key string, value interface{}) error {
+	svalue, err := json.Marshal(value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.data[key] = svalue
+	return errors.Trace(s.sign())
+}
+
+func (s *session) DeleteValue(_ context.Context, key string) error {
+	delete(s.data, key)
+	return errors.Trace(s.sign())
+}
+
+func (s *session) GetValue(key string) ([]byte, error) {
+	v, ok := s.data[key]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+
+	return []byte(v), nil
+}
+
+func (s *session) GetInt64(key string) (int64, error) {
+	val, err := s.GetValue(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var intval int64
+	err = json.Unmarshal(val, &intval)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return intval, nil
+}
+
+func (s *session) GetString(key string) (string, error) {
+	val, err := s.GetValue(key)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var strval string
+	err = json.Unmarshal(val, &strval)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return strval, nil
+}
+
+func (s *store) SessionAuthHash(user django.User) string {
+	return django.SessionAuthHash(user, s.options.Secret)
+}
+
+func (s *session) GetUser(ctx context.Context) (django.User, error) {
+	user, err := django.UserFromSession(
+		ctx, s, s.store.auth,
+		s.store.options.Secret, s.store.options.SecretFallbacks,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return user, nil
+}
+
+// Destroy empties the session and its key, the session cookie should then be
+// deleted.
+func (s *session) Destroy(context.Context) error {
+	s.data = make(map[string]json.RawMessage)
+	s.key = ""
+	return nil
+}
+
+// CycleKey re-signs the session, which gives it a new key as the timestamp is
+// part of it. An empty session without a key keeps having none.
+func (s *session) CycleKey(context.Context) error {
+	if s.key == "" && len(s.data) == 0 {
+		return nil
+	}
+	return errors.Trace(s.sign())
+}
+
+// Flush empties the session, like Destroy.
+func (s *session) Flush(ctx context.Context) error {
+	return errors.Trace(s.Destroy(ctx))
+}
+
+func (s *session) Store() django.SessionStore {
+	return s.store
+}
+
+func (s *session) String() string {
+	return fmt.Sprintf("key=%s data=%v", s.key, s.data)
+}
@@ -0,0 +1,207 @@
+package cookie
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/inconshreveable/log15"
+)
+
+func init() {
+	amalgam.LOGGER = log15.New()
+	amalgam.LOGGER.SetHandler(log15.DiscardHandler())
+}
+
+// these are the cookies signing.dumps() makes for django's signed_cookies
+// backend with SECRET_KEY = "predictable-key", at the time django's signing
+// tests freeze time at, like the vectors of django/signing.
+const (
+	testSecret = "predictable-key"
+	// {"cart": [1, 2, 3]}, too short to be compressed.
+	cartCookie = "eyJjYXJ0IjpbMSwyLDNdfQ:8M0kX:pV6WNzX6FvuK70Pf50dmHEClSEiW0AxjHVkZwjfD628"
+	// the same, signed with "old-key".
+	oldKeyCartCookie = "eyJjYXJ0IjpbMSwyLDNdfQ:8M0kX:lWDDQaG6WwWyPAvsJ1008V-CyIvk27Xj_vu93POsSQ8"
+	// a logged in user, zlib compressed.
+	loginCookie = ".eJxVjM0OwiAQhN-FsyGF8qMevfcZyC67SNVAUtqT8d2lSQ96muSbb-YtAmxrDlvjJcwkrsJocfqFCPHJZW_oAeVeZaxlXWaUuyKPtsmpEr9uh_t3kKHlvkZHmiy6pHAgmzQr9FFxzzTEC53Bo4uWDI9JQ3d2xj45sGjiSFp8vjtvOXU:8M0kX:Q2Sq8bEVxmsGh5lrqT7TZMeaQl0IN3Z8zpyoC5Pycn8"
+)
+
+// signedAt is when the cookies above were signed.
+var signedAt = time.Unix(123456789, 0)
+
+// testStore accepts cookies signed up to age ago.
+func testStore(age time.Duration, fallbacks ...string) *store {
+	return NewCustomSessionStore(nil, SessionOptions{
+		Secret: testSecret, SecretFallbacks: fallbacks, CookieAge: age,
+	}).(*store)
+}
+
+func TestLoadsDjangoCookies(t *testing.T) {
+	s := testStore(time.Since(signedAt) + time.Hour)
+	ctx := context.Background()
+
+	ss, err := s.GetSessionBySessionKey(ctx, loginCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := ss.GetString("_auth_user_id"); err != nil || id != "42" {
+		t.Errorf("_auth_user_id = %q, %v", id, err)
+	}
+	backend, err := ss.GetString("_auth_user_backend")
+	if err != nil || backend != "django.contrib.auth.backends.ModelBackend" {
+		t.Errorf("_auth_user_backend = %q, %v", backend, err)
+	}
+	if ss.SessionKey() != loginCookie {
+		t.Errorf("key changed to %s", ss.SessionKey())
+	}
+
+	ss, err = s.GetSessionBySessionKey(ctx, cartCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart, err := ss.GetValue("cart"); err != nil || string(cart) != "[1,2,3]" {
+		t.Errorf("cart = %s, %v", cart, err)
+	}
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := testStore(time.Hour)
+
+	ss, err := s.CreateSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.SessionKey() != "" {
+		t.Fatalf("empty session has key %s", ss.SessionKey())
+	}
+	if err := ss.SetValue(ctx, "_auth_user_id", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.SetValue(ctx, "visits", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := s.GetSessionBySessionKey(ctx, ss.SessionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := loaded.GetString("_auth_user_id"); err != nil || id != "42" {
+		t.Errorf("_auth_user_id = %q, %v", id, err)
+	}
+	if n, err := loaded.GetInt64("visits"); err != nil || n != 3 {
+		t.Errorf("visits = %d, %v", n, err)
+	}
+
+	if err := loaded.(*session).DeleteValue(ctx, "visits"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = s.GetSessionBySessionKey(ctx, loaded.SessionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.GetValue("visits"); err == nil {
+		t.Error("deleted value still in the cookie")
+	}
+}
+
+func TestCookieExpiry(t *testing.T) {
+	ctx := context.Background()
+	age := time.Since(signedAt)
+
+	cases := []struct {
+		name  string
+		age   time.Duration
+		valid bool
+	}{
+		{"within max_age", age + time.Hour, true},
+		{"past max_age", age - time.Hour, false},
+		{"SESSION_COOKIE_AGE", 0, false},
+	}
+
+	for _, c := range cases {
+		ss, err := testStore(c.age).GetSessionBySessionKey(ctx, cartCookie)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		_, err = ss.GetValue("cart")
+		if valid := err == nil; valid != c.valid {
+			t.Errorf("%s: valid = %v", c.name, valid)
+		}
+		if !c.valid && ss.SessionKey() != "" {
+			t.Errorf("%s: expired session kept key %s", c.name, ss.SessionKey())
+		}
+	}
+}
+
+func TestCookieTampering(t *testing.T) {
+	ctx := context.Background()
+	age := time.Since(signedAt) + time.Hour
+
+	// "cart": [1, 2, 4]
+	tampered := "eyJjYXJ0IjpbMSwyLDRdfQ" + cartCookie[len("eyJjYXJ0IjpbMSwyLDNdfQ"):]
+	cases := []struct {
+		name   string
+		cookie string
+		store  *store
+		valid  bool
+	}{
+		{"changed payload", tampered, testStore(age), false},
+		{
+			"changed timestamp", cartCookie[:23] + "8M0kY" + cartCookie[28:],
+			testStore(age), false,
+		},
+		{"no signature", cartCookie[:28], testStore(age), false},
+		{"garbage", "not a cookie", testStore(age), false},
+		{"other key", oldKeyCartCookie, testStore(age), false},
+		{"fallback key", oldKeyCartCookie, testStore(age, "old-key"), true},
+	}
+
+	for _, c := range cases {
+		ss, err := c.store.GetSessionBySessionKey(ctx, c.cookie)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		_, err = ss.GetValue("cart")
+		if valid := err == nil; valid != c.valid {
+			t.Errorf("%s: valid = %v", c.name, valid)
+		}
+		if !c.valid && ss.SessionKey() != "" {
+			t.Errorf("%s: got key %s", c.name, ss.SessionKey())
+		}
+	}
+}
+
+func TestCookieSaveEveryRequest(t *testing.T) {
+	defer func(v bool) { amalgam.SessionSaveEveryRequest = v }(
+		amalgam.SessionSaveEveryRequest,
+	)
+	amalgam.SessionSaveEveryRequest = true
+	ctx := context.Background()
+
+	ss, err := testStore(time.Since(signedAt)+time.Hour).
+		GetSessionBySessionKey(ctx, cartCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed again now, so the cookie lasts another SESSION_COOKIE_AGE.
+	if ss.SessionKey() == cartCookie {
+		t.Fatal("session was not signed again")
+	}
+	fresh, err := testStore(time.Hour).GetSessionBySessionKey(ctx, ss.SessionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart, err := fresh.GetValue("cart"); err != nil || string(cart) != "[1,2,3]" {
+		t.Errorf("cart = %s, %v", cart, err)
+	}
+
+	empty, err := testStore(time.Hour).GetSessionBySessionKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.SessionKey() != "" {
+		t.Errorf("empty session got key %s", empty.SessionKey())
+	}
+}
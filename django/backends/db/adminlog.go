@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// changeFlag is LogEntry.CHANGE, django_admin_log entries written here only
+// record changes.
+const changeFlag = 2
+
+// fieldLabels are the labels django's UserChangeForm gives the fields of
+// AbstractUser, used when logging which fields changed.
+var fieldLabels = map[string]string{
+	"email":        "Email address",
+	"is_active":    "Active",
+	"is_staff":     "Staff status",
+	"is_superuser": "Superuser status",
+}
+
+func fieldLabel(column string) string {
+	if label, ok := fieldLabels[column]; ok {
+		return label
+	}
+
+	label := strings.Replace(column, "_", " ", -1)
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+// changeMessage is the json django's admin stores in change_message for
+// changed fields, django shows it as "Changed First name and Last name.".
+func (s *astore) changeMessage(columns []string) string {
+	labels := []string{}
+	for _, c := range columns {
+		if c != "last_login" && c != s.model.ConcurrencyField {
+			labels = append(labels, fieldLabel(c))
+		}
+	}
+
+	message, _ := json.Marshal([]map[string]interface{}{
+		{"changed": map[string]interface{}{"fields": labels}},
+	})
+	return string(message)
+}
+
+// contentTypeID returns the django_content_type id of the user model, or an
+// invalid id if the table does not have it.
+func (s *astore) contentTypeID(ctx context.Context) (sql.NullInt64, error) {
+	parts := strings.SplitN(s.model.ContentType, ".", 2)
+
+	var id sql.NullInt64
+	query := "SELECT id FROM " + s.ContentTypeTable +
+		" WHERE app_label = $1 AND model = $2"
+	ctid, err := amalgam.QueryIntoInt(ctx, query, parts[0], parts[1])
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return id, nil
+		}
+		return id, errors.Trace(err)
+	}
+
+	id.Int64, id.Valid = int64(ctid), true
+	return id, nil
+}
+
+// logChange writes a django_admin_log entry for u by actor, in the request
+// transaction so it is only kept if the change is.
+func (u *user) logChange(
+	ctx context.Context, actor django.User, message string,
+) error {
+	ctid, err := u.store.contentTypeID(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	repr := []rune(u.stringField(u.store.model.UsernameField))
+	if len(repr) > 200 {
+		repr = repr[:200]
+	}
+
+	query := "INSERT INTO " + u.store.AdminLogTable + ` (
+		action_time, object_id, object_repr, action_flag, change_message,
+		content_type_id, user_id
+	) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	err = amalgam.Exec(
+		ctx, query, time.Now(), strconv.FormatInt(u.DID, 10), string(repr),
+		changeFlag, message, ctid, actor.ID(),
+	)
+	return errors.Trace(err)
+}
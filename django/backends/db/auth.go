@@ -2,22 +2,24 @@ package db
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
-	"crypto/rand"
-	"database/sql"
 	"github.com/amitu/amalgam"
 	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/hashers"
 	"github.com/juju/errors"
-	"time"
 )
 
 type group struct {
 	DId   int64  `db:"id"`
 	DName string `db:"name"`
 
-	store *store
+	store *astore
 }
 
 func (g *group) ID() int64 {
@@ -29,40 +31,25 @@ func (g *group) Name() string {
 }
 
 func (g *group) Permissions(ctx context.Context) ([]django.Permission, error) {
-	perms := []*permission{}
-	q := `
-		SELECT
-			auth_permission.id,
-			auth_permission.name,
-			auth_permission.codename
-		FROM
-			auth_permission
-		JOIN auth_group_permissions
-			ON
-				(auth_permission.id = auth_group_permissions.permission_id)
-		WHERE
-			group_id = $1
-	`
-
-	err := amalgam.QueryIntoSlice(ctx, &perms, q, g.DId)
+	q := g.store.permissionQuery(
+		"WHERE p.id IN (SELECT permission_id FROM " +
+			g.store.GroupPermissionsTable + " WHERE group_id = $1)",
+	)
+
+	perms, err := g.store.queryPermissions(ctx, q, g.DId)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	cperms := []django.Permission{}
-	for _, g := range perms {
-		cperms = append(cperms, g)
-	}
-
-	return cperms, nil
+	return toPermissions(perms), nil
 }
 
 type permission struct {
-	DId   int64  `db:"id"`
-	DName string `db:"name"`
-	DCode string `db:"codename"`
-
-	store *astore
+	DId            int64  `db:"id"`
+	DName          string `db:"name"`
+	DCode          string `db:"codename"`
+	DContentTypeID int64  `db:"content_type_id"`
+	DAppLabel      string `db:"app_label"`
 }
 
 func (p *permission) ID() int64 {
@@ -77,123 +64,439 @@ func (p *permission) Code() string {
 	return p.DCode
 }
 
+func (p *permission) AppLabel() string {
+	return p.DAppLabel
+}
+
+func toPermissions(perms []*permission) []django.Permission {
+	cperms := []django.Permission{}
+	for _, p := range perms {
+		cperms = append(cperms, p)
+	}
+	return cperms
+}
+
 type user struct {
-	DID     int64 `db:"id" json:"id"`
-	DFields map[string]interface{}
-	store   *astore
+	DID int64 `db:"id" json:"id"`
+	// model is a pointer to the struct of the user model, loaded has the
+	// values it had when it was loaded or last saved.
+	model  interface{}
+	loaded map[string]interface{}
+	store  *astore
+	// ctx is the context the user was loaded with, methods of django.User that
+	// do not take a context use it to talk to the database.
+	ctx context.Context
+
+	// perms and memberOf cache Permissions() and Roles() until
+	// RefreshFromDB(), users are loaded per request so they are never stale
+	// for long.
+	perms    []*permission
+	memberOf []*group
 }
 
 func (u *user) ID() int64 {
 	return u.DID
 }
 
+// Field returns the value of a column of the user model, nullable columns are
+// nil or their value.
 func (u *user) Field(key string) (interface{}, bool) {
-	val, ok := u.DFields[key]
-	if !ok {
-		return nil, false
-	}
+	return u.store.model.get(u.model, key)
+}
 
-	return val, true
+func (u *user) stringField(key string) string {
+	switch v, _ := u.Field(key); v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
 }
 
+// Email returns the EMAIL_FIELD of the user model.
 func (u *user) Email() string {
-	panic("not implemented")
-	return ""
+	if u.store.model.EmailField == "" {
+		return ""
+	}
+	return u.stringField(u.store.model.EmailField)
+}
+
+func (u *user) password() string {
+	return u.stringField("password")
+}
+
+func (u *user) isActive() bool {
+	// like django's ModelBackend, user models without is_active are active.
+	v, _ := u.Field("is_active")
+	active, ok := v.(bool)
+	return active || !ok
 }
 
-func (u *user) CheckPassword(string) bool {
-	panic("not implemented")
-	return false
+// CheckPassword returns true if raw matches the stored password hash. If the
+// hash was made with stale parameters it is replaced and saved right away.
+func (u *user) CheckPassword(raw string) bool {
+	valid, mustUpdate := hashers.CheckPassword(raw, u.password())
+	if valid && mustUpdate {
+		// not a change of the password, so it is not logged.
+		err := u.setPassword(raw)
+		if err == nil {
+			err = u.save(u.ctx, []string{"password"})
+		}
+		if err != nil {
+			amalgam.LOGGER.Error(
+				"password_upgrade_failed", "user", u.DID,
+				"err", errors.ErrorStack(err),
+			)
+		}
+	}
+
+	return valid
+}
+
+// groups returns the groups of the user, they are read once and cached like
+// the permissions.
+func (u *user) groups() ([]*group, error) {
+	if u.memberOf != nil {
+		return u.memberOf, nil
+	}
+
+	groups := []*group{}
+	query := "SELECT id, name FROM " + u.store.GroupTable + " WHERE id IN (" +
+		"SELECT group_id FROM " + u.store.UserGroupsTable +
+		" WHERE user_id = $1) ORDER BY name"
+	err := amalgam.QueryIntoSlice(u.ctx, &groups, query, u.DID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	u.memberOf = groups
+	return groups, nil
 }
 
 func (u *user) Roles() ([]string, error) {
-	panic("not implemented")
-	return nil, nil
+	groups, err := u.groups()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	roles := []string{}
+	for _, g := range groups {
+		roles = append(roles, g.DName)
+	}
+	return roles, nil
+}
+
+func (u *user) permissions() ([]*permission, error) {
+	if u.perms != nil {
+		return u.perms, nil
+	}
+
+	var perms []*permission
+	var err error
+	switch {
+	case !u.isActive():
+		perms = []*permission{}
+	case u.IsSuperUser():
+		perms, err = u.store.queryPermissions(
+			u.ctx, u.store.permissionQuery(""),
+		)
+	default:
+		q := u.store.permissionQuery(
+			"WHERE p.id IN (SELECT permission_id FROM " +
+				u.store.UserPermissionsTable + " WHERE user_id = $1) " +
+				"OR p.id IN (SELECT gp.permission_id FROM " +
+				u.store.GroupPermissionsTable + " gp JOIN " +
+				u.store.UserGroupsTable + " ug ON ug.group_id = gp.group_id " +
+				"WHERE ug.user_id = $1)",
+		)
+		perms, err = u.store.queryPermissions(u.ctx, q, u.DID)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	u.perms = perms
+	return perms, nil
 }
 
 func (u *user) Permissions() ([]django.Permission, error) {
-	panic("not implemented")
-	return nil, nil
+	perms, err := u.permissions()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return toPermissions(perms), nil
 }
 
-func (u *user) HasRole(ctx context.Context, roleId int64) (bool, error) {
-	query := "SELECT count(*) FROM " + u.store.UserGroupsTable +
-		" WHERE user_id = $1 AND group_id = $2"
-	num, err := amalgam.QueryIntoInt(ctx, query, u.DID, roleId)
+// HasRole answers from the groups Roles() caches, so checking several roles
+// takes one query.
+func (u *user) HasRole(_ context.Context, roleId int64) (bool, error) {
+	groups, err := u.groups()
 	if err != nil {
 		return false, errors.Trace(err)
 	}
 
-	return num != 0, nil
+	for _, g := range groups {
+		if g.DId == roleId {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (u *user) HasPermission(string) (bool, error) {
-	panic("not implemented")
+func (u *user) HasPermission(perm string) (bool, error) {
+	if !u.isActive() {
+		return false, nil
+	}
+	if u.IsSuperUser() {
+		return true, nil
+	}
+
+	perms, err := u.permissions()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	for _, p := range perms {
+		if django.PermissionString(p) == perm {
+			return true, nil
+		}
+	}
+
 	return false, nil
 }
 
-func (u *user) SetName(string, bool) error {
-	panic("not implemented")
-	return nil
+// SetName sets first_name and last_name, name is split at its first space.
+// Saved changes are logged to django_admin_log.
+func (u *user) SetName(name string, save bool) error {
+	first, last := strings.TrimSpace(name), ""
+	if idx := strings.Index(first, " "); idx != -1 {
+		first, last = first[:idx], strings.TrimSpace(first[idx+1:])
+	}
+
+	if err := u.store.model.set(u.model, "first_name", first); err != nil {
+		return errors.Trace(err)
+	}
+	if err := u.store.model.set(u.model, "last_name", last); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !save {
+		return nil
+	}
+	return errors.Trace(
+		u.saveAndLog(u.ctx, []string{"first_name", "last_name"}, ""),
+	)
 }
 
-func (u *user) SetEmail(string, bool) error {
-	panic("not implemented")
-	return nil
+// SetEmail sets the EMAIL_FIELD, with the domain lower cased like django's
+// normalize_email(). Saved changes are logged to django_admin_log.
+func (u *user) SetEmail(email string, save bool) error {
+	field := u.store.model.EmailField
+	if field == "" {
+		return errors.Annotate(errNoSuchField, "user model has no email")
+	}
+
+	email = strings.TrimSpace(email)
+	if idx := strings.LastIndex(email, "@"); idx != -1 {
+		email = email[:idx] + strings.ToLower(email[idx:])
+	}
+
+	if err := u.store.model.set(u.model, field, email); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !save {
+		return nil
+	}
+	return errors.Trace(u.saveAndLog(u.ctx, []string{field}, ""))
 }
 
-func (u *user) SetPassword(string, bool) error {
-	panic("not implemented")
-	return nil
+// SetPassword hashes raw with the preferred hasher. Saved changes are logged
+// to django_admin_log.
+func (u *user) SetPassword(raw string, save bool) error {
+	if err := u.setPassword(raw); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !save {
+		return nil
+	}
+	return errors.Trace(u.saveAndLog(u.ctx, []string{"password"}, ""))
+}
+
+func (u *user) setPassword(raw string) error {
+	encoded, err := hashers.MakePassword(raw)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(u.store.model.set(u.model, "password", encoded))
 }
 
+// Save writes the columns changed since the user was loaded and logs them to
+// django_admin_log as the actor of ctx. With UserModel.ConcurrencyField it
+// returns django.ErrConflict if someone else saved the user in the meantime.
 func (u *user) Save(ctx context.Context) error {
-	var values string
-	index := 1
-	var fields []interface{}
-	for k, v := range u.DFields {
-		if k == "id" {
+	return errors.Trace(u.saveAndLog(ctx, u.store.model.columns, ""))
+}
+
+// saveAndLog saves those of columns that changed and logs the change with
+// message, or with the changed fields if message is empty. Every change is
+// logged, so without an actor in ctx nothing is saved and the error wraps
+// django.ErrNoUser.
+func (u *user) saveAndLog(
+	ctx context.Context, columns []string, message string,
+) error {
+	changed := []string{}
+	for _, c := range u.store.model.changed(u.model, u.loaded) {
+		if containsString(columns, c) {
+			changed = append(changed, c)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	actor, err := django.Ctx2Actor(ctx)
+	if err != nil {
+		return errors.Annotate(err, "no actor to log the change as")
+	}
+
+	if err := u.save(ctx, changed); err != nil {
+		return errors.Trace(err)
+	}
+
+	if message == "" {
+		message = u.store.changeMessage(changed)
+	}
+	return errors.Trace(u.logChange(ctx, actor, message))
+}
+
+// save writes columns, like django's save(update_fields=columns).
+func (u *user) save(ctx context.Context, columns []string) error {
+	m := u.store.model
+
+	sets := []string{}
+	args := []interface{}{}
+	for _, c := range columns {
+		if c == "id" || c == m.ConcurrencyField {
 			continue
 		}
-		values = values + k + "=$" + strconv.Itoa(index) + ","
-		fields = append(fields, v)
-		index++
+		f, _ := m.field(u.model, c, false)
+		args = append(args, value(f))
+		sets = append(sets, quoteIdent(c)+" = $"+strconv.Itoa(len(args)))
+	}
+	if len(sets) == 0 {
+		return nil
 	}
-	values = values + "id" + "=$" + strconv.Itoa(index)
-	fields = append(fields, u.DFields["id"])
 
-	query := "UPDATE " + u.store.UserTable + " SET " +
-		values + "WHERE id=$" + strconv.Itoa(index) + ";"
+	args = append(args, u.DID)
+	where := quoteIdent("id") + " = $" + strconv.Itoa(len(args))
 
-	err := amalgam.Exec(ctx, query, fields...)
+	var version interface{}
+	if m.ConcurrencyField != "" {
+		next, err := m.nextVersion(u.model)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		version = next
+		column := quoteIdent(m.ConcurrencyField)
+
+		args = append(args, next)
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+		if old := u.loaded[m.ConcurrencyField]; old == nil {
+			where += " AND " + column + " IS NULL"
+		} else {
+			args = append(args, old)
+			where += " AND " + column + " = $" + strconv.Itoa(len(args))
+		}
+	}
+
+	tx, err := amalgam.Ctx2Tx(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	query := "UPDATE " + quoteIdent(u.store.UserTable) + " SET " +
+		strings.Join(sets, ", ") + " WHERE " + where
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if rows == 0 {
+		amalgam.LOGGER.Warn("user_save_conflict", "user", u.DID)
+		return errors.Annotatef(django.ErrConflict, "user %d", u.DID)
+	}
+
+	if m.ConcurrencyField != "" {
+		if err := m.set(u.model, m.ConcurrencyField, version); err != nil {
+			return errors.Trace(err)
+		}
+		columns = append(columns, m.ConcurrencyField)
+	}
+	for _, c := range columns {
+		u.loaded[c], _ = m.get(u.model, c)
+	}
 
 	return nil
 }
 
+// RefreshFromDB reloads the user into the same model struct, so pointers
+// returned by Model() see the new values.
 func (u *user) RefreshFromDB(ctx context.Context) error {
-	query := "SELECT * FROM " + u.store.AuthTables.UserTable +
-		" WHERE id = $1"
-
-	userMap, err := amalgam.QueryIntoMap(ctx, query, u.DID)
+	fresh, err := u.store.selectUser(ctx, "id = $1", u.DID)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	u.DFields = userMap
 
+	reflect.ValueOf(u.model).Elem().Set(reflect.ValueOf(fresh.model).Elem())
+	u.loaded = fresh.loaded
+	u.perms, u.memberOf = nil, nil
 	return nil
 }
 
+func (u *user) UpdateLastLogin(ctx context.Context) error {
+	if _, ok := u.Field("last_login"); !ok {
+		return nil
+	}
+
+	if err := u.store.model.set(u.model, "last_login", time.Now()); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(u.save(ctx, []string{"last_login"}))
+}
+
+// Deactivate sets is_active to false and saves it right away. The reason is
+// the change message of the django_admin_log entry.
 func (u *user) Deactivate(reason string) error {
-	panic("not implemented")
+	if err := u.store.model.set(u.model, "is_active", false); err != nil {
+		return errors.Trace(err)
+	}
+
+	message := ""
+	if reason != "" {
+		message = "Deactivated: " + reason
+	}
+	if err := u.saveAndLog(u.ctx, []string{"is_active"}, message); err != nil {
+		return errors.Trace(err)
+	}
+
+	amalgam.LOGGER.Info("user_deactivated", "user", u.DID, "reason", reason)
 	return nil
 }
 
 func (u *user) IsSuperUser() bool {
-	panic("not implemented")
-	return false
+	v, _ := u.Field("is_superuser")
+	superuser, _ := v.(bool)
+	return superuser
 }
 
 type AuthTables struct {
@@ -203,13 +506,23 @@ type AuthTables struct {
 	UserGroupsTable       string
 	UserPermissionsTable  string
 	GroupPermissionsTable string
+	ContentTypeTable      string
+	// AdminLogTable is the table of django.contrib.admin's LogEntry.
+	AdminLogTable string
+	// TokenTable is django rest framework's authtoken table.
+	TokenTable string
+	// APIKeyTable holds API keys in APIKeyColumn next to a user_id column,
+	// like a user profile table. django has no such table, so there is no
+	// default and UserByAPIKey() fails with ErrNoAPIKeyTable until it is set.
+	APIKeyTable  string
+	APIKeyColumn string
 }
 
 func updateAuthTablesWithDefault(at *AuthTables) {
 	if at.UserTable == "" {
 		at.UserTable = "auth_user"
 	}
-	if at.UserTable == "" {
+	if at.GroupTable == "" {
 		at.GroupTable = "auth_group"
 	}
 	if at.PermissionTable == "" {
@@ -224,10 +537,44 @@ func updateAuthTablesWithDefault(at *AuthTables) {
 	if at.GroupPermissionsTable == "" {
 		at.GroupPermissionsTable = "auth_group_permissions"
 	}
+	if at.ContentTypeTable == "" {
+		at.ContentTypeTable = "django_content_type"
+	}
+	if at.AdminLogTable == "" {
+		at.AdminLogTable = "django_admin_log"
+	}
+	if at.TokenTable == "" {
+		at.TokenTable = "authtoken_token"
+	}
+	if at.APIKeyColumn == "" {
+		at.APIKeyColumn = "api_key"
+	}
 }
 
 type astore struct {
 	AuthTables
+	model *userModel
+}
+
+// permissionQuery selects permissions along with the app label of their
+// content type, where filters them on the "p" alias.
+func (s *astore) permissionQuery(where string) string {
+	return "SELECT p.id, p.name, p.codename, p.content_type_id, ct.app_label" +
+		" FROM " + s.PermissionTable + " p JOIN " + s.ContentTypeTable +
+		" ct ON ct.id = p.content_type_id " + where +
+		" ORDER BY ct.app_label, p.codename"
+}
+
+func (s *astore) queryPermissions(
+	ctx context.Context, query string, args ...interface{},
+) ([]*permission, error) {
+	perms := []*permission{}
+	err := amalgam.QueryIntoSlice(ctx, &perms, query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return perms, nil
 }
 
 func (s *astore) Groups(ctx context.Context) ([]django.Group, error) {
@@ -240,6 +587,7 @@ func (s *astore) Groups(ctx context.Context) ([]django.Group, error) {
 
 	cgroups := []django.Group{}
 	for _, g := range groups {
+		g.store = s
 		cgroups = append(cgroups, g)
 	}
 
@@ -247,7 +595,7 @@ func (s *astore) Groups(ctx context.Context) ([]django.Group, error) {
 }
 
 func (s *astore) GroupByID(ctx context.Context, id int64) (django.Group, error) {
-	group := group{}
+	group := group{store: s}
 	query := fmt.Sprintf("SELECT * FROM %s WHERE id = $1", s.GroupTable)
 	err := amalgam.QueryIntoStruct(ctx, &group, query, id)
 	if err != nil {
@@ -260,7 +608,7 @@ func (s *astore) GroupByID(ctx context.Context, id int64) (django.Group, error)
 func (s *astore) GroupByName(
 	ctx context.Context, name string,
 ) (django.Group, error) {
-	group := group{}
+	group := group{store: s}
 	query := fmt.Sprintf("SELECT * FROM %s WHERE name = $1", s.GroupTable)
 	err := amalgam.QueryIntoStruct(ctx, &group, query, name)
 	if err != nil {
@@ -270,132 +618,226 @@ func (s *astore) GroupByName(
 	return &group, nil
 }
 
-func (s *astore) UserByID(ctx context.Context, id int64) (django.User, error) {
-	u := &user{}
-	query := "SELECT * FROM " + s.UserTable +
-		" WHERE id = $1"
+// selectUser loads the user matching where into a new model struct.
+func (s *astore) selectUser(
+	ctx context.Context, where string, args ...interface{},
+) (*user, error) {
+	model := reflect.New(s.model.typ).Interface()
+	query := "SELECT " + s.model.selectColumns() + " FROM " +
+		quoteIdent(s.UserTable) + " WHERE " + where
 
-	userMap, err := amalgam.QueryIntoMap(ctx, query, id)
+	err := amalgam.QueryIntoStruct(ctx, model, query, args...)
 	if err != nil {
-		return u, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	u.DID = userMap["id"].(int64)
-	u.DFields = userMap
-	u.store = s
+	return s.newUser(ctx, model), nil
+}
+
+func (s *astore) newUser(ctx context.Context, model interface{}) *user {
+	id, _ := s.model.get(model, "id")
+	return &user{
+		DID: id.(int64), model: model, loaded: s.model.snapshot(model),
+		store: s, ctx: ctx,
+	}
+}
+
+func (s *astore) UserByID(ctx context.Context, id int64) (django.User, error) {
+	u, err := s.selectUser(ctx, "id = $1", id)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	return u, nil
 }
 
+// ErrNoAPIKeyTable is returned by UserByAPIKey() if AuthTables.APIKeyTable is
+// not set.
+var ErrNoAPIKeyTable = errors.New("no API key table configured")
+
 func (s *astore) UserByAPIKey(
 	ctx context.Context, apiKey string,
 ) (django.User, error) {
-	u := &user{}
-	query := "SELECT * FROM " + s.UserTable +
-		" WHERE id = (select user_id from acko_userprofile where api_key= $1)"
+	if s.APIKeyTable == "" {
+		return nil, errors.Trace(ErrNoAPIKeyTable)
+	}
 
-	userMap, err := amalgam.QueryIntoMap(ctx, query, apiKey)
+	u, err := s.selectUser(
+		ctx, "id = (SELECT user_id FROM "+s.APIKeyTable+
+			" WHERE "+s.APIKeyColumn+" = $1)",
+		apiKey,
+	)
 	if err != nil {
-		return u, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	u.DID = userMap["id"].(int64)
-	u.DFields = userMap
-	u.store = s
+	return u, nil
+}
+
+func (s *astore) UserByToken(
+	ctx context.Context, key string,
+) (django.User, error) {
+	u, err := s.selectUser(
+		ctx, "id = (SELECT user_id FROM "+s.TokenTable+" WHERE key = $1)", key,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	return u, nil
 }
 
+// UserByPhone looks users up by UserModel.PhoneField.
 func (s *astore) UserByPhone(
 	ctx context.Context, phone string,
 ) (django.User, error) {
-	u := &user{}
-	query := "SELECT * FROM " + s.UserTable +
-		" WHERE phone = $1"
+	if s.model.PhoneField == "" {
+		return nil, errors.Annotate(errNoSuchField, "user model has no phone")
+	}
 
-	userMap, err := amalgam.QueryIntoMap(ctx, query, phone)
+	u, err := s.selectUser(ctx, quoteIdent(s.model.PhoneField)+" = $1", phone)
 	if err != nil {
-		return u, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	u.DID = userMap["id"].(int64)
-	u.DFields = userMap
-	u.store = s
-
 	return u, nil
 }
 
+// GetOrCreateUser returns the user with the phone in details, or creates one.
+// details maps columns to values, the phone may also be given as "phone".
+// Columns not in details get the values of UserModel.New, and the password
+// is unusable unless details has one.
 func (s *astore) GetOrCreateUser(
 	ctx context.Context, details map[string]interface{},
 ) (django.User, error) {
-	u := &user{}
-	query := "SELECT * FROM " + s.UserTable +
-		" WHERE phone = $1"
-
-	phone := details["phone"].(string)
-	first_name := details["first_name"].(string)
-	last_name := details["first_name"].(string)
-
-	userMap, err := amalgam.QueryIntoMap(ctx, query, phone)
-	if err != nil {
-		if err.Error() == sql.ErrNoRows.Error() {
-			b := make([]byte, 8)
-			if _, err := rand.Read(b); err != nil {
-				panic(err)
-			}
-			password := fmt.Sprintf("%X", b)
-
-			query := "INSERT INTO " +
-				s.UserTable + "(" + "phone, password, is_superuser, " +
-				"first_name, " + "last_name, is_staff, is_active, joined_on, " +
-				"available, idle, is_online, on_call) " + "VALUES " +
-				"($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
-
-			err := amalgam.Exec(
-				ctx, query, phone, password, false, first_name, last_name,
-				false, false, time.Now(), false, true, false, false,
-			)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
+	phone, ok := details[s.model.PhoneField]
+	if !ok {
+		phone = details["phone"]
+	}
+	phoneString, _ := phone.(string)
+
+	u, err := s.UserByPhone(ctx, phoneString)
+	if err == nil || errors.Cause(err) != sql.ErrNoRows {
+		return u, errors.Trace(err)
+	}
 
-			query = "SELECT * FROM " + s.UserTable +
-				" WHERE phone = $1"
+	model := s.model.New()
+	for column, value := range details {
+		if column == "phone" && s.model.PhoneField != "phone" {
+			column = s.model.PhoneField
+		}
+		if err := s.model.set(model, column, value); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if p, _ := s.model.get(model, "password"); p == "" {
+		err := s.model.set(model, "password", hashers.MakeUnusablePassword())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 
-			userMap, err = amalgam.QueryIntoMap(ctx, query, phone)
-		} else {
-			return u, errors.Trace(err)
+	if s.model.ConcurrencyField != "" {
+		version, err := s.model.nextVersion(model)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := s.model.set(model, s.model.ConcurrencyField, version); err != nil {
+			return nil, errors.Trace(err)
 		}
 	}
 
-	u.DID = userMap["id"].(int64)
-	u.DFields = userMap
-	u.store = s
+	columns := []string{}
+	quoted := []string{}
+	placeholders := []string{}
+	for _, c := range s.model.columns {
+		if c != "id" {
+			columns = append(columns, c)
+			quoted = append(quoted, quoteIdent(c))
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(columns)))
+		}
+	}
 
-	return u, nil
+	query := "INSERT INTO " + quoteIdent(s.UserTable) + " (" +
+		strings.Join(quoted, ", ") + ") VALUES (" +
+		strings.Join(placeholders, ", ") + ") RETURNING id"
+	id, err := amalgam.QueryIntoInt(
+		ctx, query, s.model.values(model, columns)...,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := s.model.set(model, "id", int64(id)); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.newUser(ctx, model), nil
+}
+
+// HasUserField reports if the user model has the column name.
+func (s *astore) HasUserField(name string) bool {
+	_, ok := s.model.fields[name]
+	return ok
 }
 
-func (s *astore) UserByEmail(context.Context, string) (django.User, error) {
-	panic("not implemented")
-	return nil, nil
+// UserByEmail looks users up by UserModel.EmailField, ignoring case like
+// django's password reset form.
+func (s *astore) UserByEmail(
+	ctx context.Context, email string,
+) (django.User, error) {
+	if s.model.EmailField == "" {
+		return nil, errors.Annotate(errNoSuchField, "user model has no email")
+	}
+
+	u, err := s.selectUser(
+		ctx, "UPPER("+quoteIdent(s.model.EmailField)+") = UPPER($1)", email,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return u, nil
 }
 
+// Authenticate works like django's ModelBackend, it returns
+// django.ErrInvalidCredentials if there is no such user, the password does not
+// match or the user is not active.
 func (s *astore) Authenticate(
-	context.Context, string, string,
+	ctx context.Context, username string, password string,
 ) (django.User, error) {
-	panic("not implemented")
-	return nil, nil
+	u, err := s.selectUser(
+		ctx, quoteIdent(s.model.UsernameField)+" = $1", username,
+	)
+	if err != nil {
+		if errors.Cause(err) != sql.ErrNoRows {
+			return nil, errors.Trace(err)
+		}
+		// Run the default password hasher once to reduce the timing
+		// difference between an existing and a nonexistent user.
+		hashers.MakePassword(password)
+		return nil, errors.Trace(django.ErrInvalidCredentials)
+	}
+
+	if !u.CheckPassword(password) || !u.isActive() {
+		return nil, errors.Trace(django.ErrInvalidCredentials)
+	}
+
+	return u, nil
 }
 
 func (s *astore) Permissions(ctx context.Context) ([]django.Permission, error) {
-	panic("not implemented")
-	return nil, nil
+	perms, err := s.queryPermissions(ctx, s.permissionQuery(""))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return toPermissions(perms), nil
 }
 
 func (s *astore) PermissionByID(ctx context.Context, id int64) (django.Permission, error) {
 	perm := permission{}
-	query := fmt.Sprintf("select * from %s where id = $1", s.PermissionTable)
-	err := amalgam.QueryIntoStruct(ctx, &permission{}, query, id)
+	query := s.permissionQuery("WHERE p.id = $1")
+	err := amalgam.QueryIntoStruct(ctx, &perm, query, id)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -403,12 +845,20 @@ func (s *astore) PermissionByID(ctx context.Context, id int64) (django.Permissio
 	return &perm, nil
 }
 
+// PermissionByCode takes "app_label.codename", or just the codename if it is
+// unique.
 func (s *astore) PermissionByCode(
 	ctx context.Context, code string,
 ) (django.Permission, error) {
 	perm := permission{}
-	query := fmt.Sprintf("select * from %s where codename = $1", s.PermissionTable)
-	err := amalgam.QueryIntoStruct(ctx, &permission{}, query, code)
+	query := s.permissionQuery("WHERE p.codename = $1")
+	args := []interface{}{code}
+	if idx := strings.Index(code, "."); idx != -1 {
+		query = s.permissionQuery("WHERE ct.app_label = $1 AND p.codename = $2")
+		args = []interface{}{code[:idx], code[idx+1:]}
+	}
+
+	err := amalgam.QueryIntoStruct(ctx, &perm, query, args...)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -416,8 +866,17 @@ func (s *astore) PermissionByCode(
 	return &perm, nil
 }
 
-func NewCustomAuthStore(ctx context.Context, auth_tables AuthTables) (django.AuthStore, error) {
+// NewCustomAuthStore creates an AuthStore for the tables in auth_tables, users
+// are loaded into the struct of model.
+func NewCustomAuthStore(
+	ctx context.Context, auth_tables AuthTables, model UserModel,
+) (django.AuthStore, error) {
 	updateAuthTablesWithDefault(&auth_tables)
+	um, err := newUserModel(model)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	query := fmt.Sprintf("SELECT count(*) FROM %s", auth_tables.GroupTable)
 	gcount, err := amalgam.QueryIntoInt(ctx, query)
 	if err != nil {
@@ -440,11 +899,11 @@ func NewCustomAuthStore(ctx context.Context, auth_tables AuthTables) (django.Aut
 		"found_auth_tables", "groups", gcount,
 		"permissions", pcount, "users", ucount,
 	)
-	return &astore{auth_tables}, nil
+	return &astore{AuthTables: auth_tables, model: um}, nil
 }
 
 func NewAuthStore(ctx context.Context) (django.AuthStore, error) {
 	auth_tables := AuthTables{}
 	updateAuthTablesWithDefault(&auth_tables)
-	return NewCustomAuthStore(ctx, auth_tables)
+	return NewCustomAuthStore(ctx, auth_tables, UserModel{})
 }
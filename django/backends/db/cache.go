@@ -0,0 +1,339 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// cacheKeyPrefix is deliberately not django's "django.contrib.sessions.cached_db"
+// as the values we cache are not readable by django.
+const cacheKeyPrefix = "amalgam.sessions.cached_db"
+
+// SessionCache is where a cached session store keeps sessions. Implement it
+// to use an external cache like memcached or redis, values must be returned
+// exactly as they were set.
+type SessionCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// CacheOptions configure the cache of NewCachedSessionStore.
+type CacheOptions struct {
+	// Cache defaults to an in-process LRU holding Size sessions.
+	Cache SessionCache
+	// Size of the default LRU cache, defaults to 10000.
+	Size int
+	// TTL caps how long a session stays cached, defaults to five minutes.
+	// Writes made by django do not invalidate this cache, so keep it short if
+	// django changes the same sessions.
+	TTL time.Duration
+	// Invalidated is called with the session key whenever a change this store
+	// made to a session commits, for example to tell other instances to call
+	// Invalidate().
+	Invalidated func(key string)
+}
+
+func updateCacheOptionsWithDefault(co *CacheOptions) {
+	if co.Size == 0 {
+		co.Size = 10000
+	}
+	if co.TTL == 0 {
+		co.TTL = time.Minute * 5
+	}
+	if co.Cache == nil {
+		co.Cache = NewLRUCache(co.Size)
+	}
+}
+
+// ErrNotCacheable is returned by NewCachedSessionStore for stores that do not
+// implement SessionEncoder.
+var ErrNotCacheable = errors.New("session store can not be cached")
+
+// SessionEncoder is implemented by session stores whose sessions
+// NewCachedSessionStore can keep in a SessionCache.
+type SessionEncoder interface {
+	// EncodeSession returns what to cache for session and when it expires.
+	EncodeSession(django.Session) ([]byte, time.Time, error)
+	// DecodeSession returns the session EncodeSession() encoded.
+	DecodeSession(key string, data []byte) (django.Session, error)
+}
+
+// CachedSessionStore is a session store that caches sessions in front of
+// another store, like django's cached_db backend.
+type CachedSessionStore interface {
+	django.SessionStore
+	// Invalidate drops the session from the cache, the next read goes to the
+	// wrapped store.
+	Invalidate(key string)
+}
+
+// NewCachedSessionStore returns a store that reads sessions of sessions
+// through a cache. Writes go to sessions and drop the cached entry once the
+// request transaction commits, instead of updating it, so a rolled back
+// write never reaches the cache. sessions must implement SessionEncoder, like
+// the stores of NewCustomSessionStore do. Those are not cached with
+// amalgam.SessionSaveEveryRequest, as each read then writes anyway.
+func NewCachedSessionStore(
+	sessions django.SessionStore, options CacheOptions,
+) (CachedSessionStore, error) {
+	encoder, ok := sessions.(SessionEncoder)
+	if !ok {
+		return nil, errors.Annotatef(ErrNotCacheable, "%T", sessions)
+	}
+
+	updateCacheOptionsWithDefault(&options)
+	s := &cachedStore{
+		SessionStore: sessions, encoder: encoder, options: options,
+	}
+	_, s.db = sessions.(*store)
+	return s, nil
+}
+
+type cachedStore struct {
+	django.SessionStore
+	encoder SessionEncoder
+	options CacheOptions
+	// db is set if sessions is a store of NewCustomSessionStore.
+	db bool
+	// invalidations counts Invalidate() calls, a session read from the
+	// wrapped store is only cached if none happened during the read, as the
+	// read may have returned what was just invalidated.
+	invalidations uint64
+}
+
+func (s *cachedStore) cacheKey(key string) string {
+	return cacheKeyPrefix + key
+}
+
+func (s *cachedStore) GetSessionBySessionKey(
+	ctx context.Context, key string,
+) (django.Session, error) {
+	if s.db && amalgam.SessionSaveEveryRequest {
+		return s.wrap(s.SessionStore.GetSessionBySessionKey(ctx, key))
+	}
+
+	if data, ok := s.options.Cache.Get(s.cacheKey(key)); ok {
+		ss, err := s.encoder.DecodeSession(key, data)
+		if err == nil {
+			return s.wrap(ss, nil)
+		}
+		amalgam.LOGGER.Warn(
+			"session_cache_decode_failed", "sessionkey", key,
+			"err", errors.ErrorStack(err),
+		)
+	}
+
+	before := atomic.LoadUint64(&s.invalidations)
+	ss, err := s.SessionStore.GetSessionBySessionKey(ctx, key)
+	if err != nil {
+		return s.wrap(ss, errors.Trace(err))
+	}
+
+	if atomic.LoadUint64(&s.invalidations) == before {
+		s.set(ss)
+	}
+	return s.wrap(ss, nil)
+}
+
+func (s *cachedStore) set(ss django.Session) {
+	data, expires, err := s.encoder.EncodeSession(ss)
+	if err != nil {
+		amalgam.LOGGER.Warn(
+			"session_cache_encode_failed", "sessionkey", ss.SessionKey(),
+			"err", errors.ErrorStack(err),
+		)
+		return
+	}
+
+	ttl := s.options.TTL
+	if left := time.Until(expires); left < ttl {
+		ttl = left
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	s.options.Cache.Set(s.cacheKey(ss.SessionKey()), data, ttl)
+}
+
+func (s *cachedStore) CreateSession(ctx context.Context) (django.Session, error) {
+	return s.wrap(s.SessionStore.CreateSession(ctx))
+}
+
+func (s *cachedStore) DestroySession(ctx context.Context, key string) error {
+	err := s.SessionStore.DestroySession(ctx, key)
+	s.changed(ctx, key)
+	return errors.Trace(err)
+}
+
+// changed invalidates keys once the transaction in ctx commits. Invalidating
+// before that would let a concurrent request cache the old session again.
+func (s *cachedStore) changed(ctx context.Context, keys ...string) {
+	amalgam.OnCommit(ctx, func() {
+		done := map[string]bool{"": true}
+		for _, key := range keys {
+			if done[key] {
+				continue
+			}
+			done[key] = true
+			s.Invalidate(key)
+			if s.options.Invalidated != nil {
+				s.options.Invalidated(key)
+			}
+		}
+	})
+}
+
+// Invalidate drops key from the cache.
+func (s *cachedStore) Invalidate(key string) {
+	amalgam.LOGGER.Debug("session_cache_invalidate", "sessionkey", key)
+	atomic.AddUint64(&s.invalidations, 1)
+	s.options.Cache.Delete(s.cacheKey(key))
+}
+
+func (s *cachedStore) wrap(ss django.Session, err error) (django.Session, error) {
+	if ss == nil {
+		return nil, err
+	}
+	return &cachedSession{Session: ss, store: s, key: ss.SessionKey()}, err
+}
+
+// cachedSession invalidates the cache whenever the wrapped session is written
+// to, both for the key it was loaded with and its current key.
+type cachedSession struct {
+	django.Session
+	store *cachedStore
+	key   string
+}
+
+func (s *cachedSession) changed(ctx context.Context) {
+	s.store.changed(ctx, s.key, s.SessionKey())
+}
+
+func (s *cachedSession) SetValue(
+	ctx context.Context, key string, value interface{},
+) error {
+	defer s.changed(ctx)
+	return errors.Trace(s.Session.SetValue(ctx, key, value))
+}
+
+func (s *cachedSession) Destroy(ctx context.Context) error {
+	defer s.changed(ctx)
+	return errors.Trace(s.Session.Destroy(ctx))
+}
+
+func (s *cachedSession) CycleKey(ctx context.Context) error {
+	defer s.changed(ctx)
+	return errors.Trace(s.Session.CycleKey(ctx))
+}
+
+func (s *cachedSession) Flush(ctx context.Context) error {
+	defer s.changed(ctx)
+	return errors.Trace(s.Session.Flush(ctx))
+}
+
+// GetUser may cycle or flush the session, see django.UserFromSession().
+func (s *cachedSession) GetUser(ctx context.Context) (django.User, error) {
+	before := s.SessionKey()
+	user, err := s.Session.GetUser(ctx)
+	if s.SessionKey() != before {
+		s.changed(ctx)
+	}
+	return user, errors.Trace(err)
+}
+
+func (s *cachedSession) Store() django.SessionStore {
+	return s.store
+}
+
+// EncodeSession caches session_data, sessions are decoded again when read
+// from the cache.
+func (s *store) EncodeSession(ss django.Session) ([]byte, time.Time, error) {
+	dbs, ok := ss.(*session)
+	if !ok {
+		return nil, time.Time{}, errors.Errorf("not a db session: %T", ss)
+	}
+	return []byte(dbs.DData), dbs.DExpireDate, nil
+}
+
+func (s *store) DecodeSession(key string, data []byte) (django.Session, error) {
+	return &session{DSessionKey: key, DData: string(data), store: s}, nil
+}
+
+// NewLRUCache returns an in-process SessionCache that holds up to size entries
+// and evicts the least recently used one when full.
+func NewLRUCache(size int) SessionCache {
+	return &lruCache{
+		size: size, items: make(map[string]*list.Element), order: list.New(),
+	}
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+type lruCache struct {
+	sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
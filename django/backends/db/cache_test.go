@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/inconshreveable/log15"
+)
+
+func init() {
+	amalgam.LOGGER = log15.New()
+	amalgam.LOGGER.SetHandler(log15.DiscardHandler())
+}
+
+// memStore is a django.SessionStore keeping session data in a map, reads
+// counts how often the cached store had to go to it.
+type memStore struct {
+	django.SessionStore
+	data  map[string]string
+	reads int
+}
+
+type memSession struct {
+	django.Session
+	store *memStore
+	key   string
+	data  string
+}
+
+func (s *memSession) SessionKey() string { return s.key }
+
+func (s *memSession) SetValue(_ context.Context, _ string, v interface{}) error {
+	s.data = v.(string)
+	s.store.data[s.key] = s.data
+	return nil
+}
+
+func (s *memSession) Flush(context.Context) error {
+	delete(s.store.data, s.key)
+	s.key, s.data = "", ""
+	return nil
+}
+
+func (s *memStore) GetSessionBySessionKey(
+	_ context.Context, key string,
+) (django.Session, error) {
+	s.reads++
+	return &memSession{store: s, key: key, data: s.data[key]}, nil
+}
+
+func (s *memStore) EncodeSession(ss django.Session) ([]byte, time.Time, error) {
+	return []byte(ss.(*memSession).data), time.Now().Add(time.Hour), nil
+}
+
+func (s *memStore) DecodeSession(key string, data []byte) (django.Session, error) {
+	return &memSession{store: s, key: key, data: string(data)}, nil
+}
+
+func TestCachedSessionStoreInvalidatesOnCommit(t *testing.T) {
+	mem := &memStore{data: map[string]string{"k": "old"}}
+	invalidated := []string{}
+	cached, err := NewCachedSessionStore(
+		mem, CacheOptions{Invalidated: func(key string) {
+			invalidated = append(invalidated, key)
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() string {
+		ss, err := cached.GetSessionBySessionKey(context.Background(), "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ss.(*cachedSession).Session.(*memSession).data
+	}
+
+	read()
+	read()
+	if mem.reads != 1 {
+		t.Fatalf("reads = %d, want 1", mem.reads)
+	}
+
+	ctx, hooks := amalgam.WithCommitHooks(context.Background())
+	ss, _ := cached.GetSessionBySessionKey(ctx, "k")
+	if err := ss.SetValue(ctx, "v", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// until the transaction commits others still get the committed session.
+	if data := read(); data != "old" || len(invalidated) != 0 {
+		t.Fatalf("before commit: data = %s, invalidated = %v", data, invalidated)
+	}
+
+	hooks.Run()
+	if data := read(); data != "new" {
+		t.Fatalf("after commit: data = %s", data)
+	}
+	if len(invalidated) != 1 || invalidated[0] != "k" {
+		t.Fatalf("invalidated = %v", invalidated)
+	}
+}
+
+func TestCachedSessionStoreFlush(t *testing.T) {
+	mem := &memStore{data: map[string]string{"k": "user"}}
+	cached, err := NewCachedSessionStore(mem, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, hooks := amalgam.WithCommitHooks(context.Background())
+	ss, _ := cached.GetSessionBySessionKey(ctx, "k")
+	if err := ss.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hooks.Run()
+
+	// the old key must not be served from the cache after a logout.
+	ss, _ = cached.GetSessionBySessionKey(context.Background(), "k")
+	if data := ss.(*cachedSession).Session.(*memSession).data; data != "" {
+		t.Fatalf("flushed session still cached: %s", data)
+	}
+}
+
+func TestCachedSessionStoreNeedsEncoder(t *testing.T) {
+	type plain struct{ django.SessionStore }
+	if _, err := NewCachedSessionStore(plain{}, CacheOptions{}); err == nil {
+		t.Fatal("store without SessionEncoder accepted")
+	}
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/amitu/amalgam/django/signing"
+	"github.com/juju/errors"
+)
+
+var (
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// SessionCodec converts session data to and from the value stored in
+// django_session.session_data.
+type SessionCodec interface {
+	Encode(map[string]json.RawMessage) (string, error)
+	Decode(string) (map[string]json.RawMessage, error)
+}
+
+// LegacyCodec reads and writes the base64(hexhmac:json) format used by django
+// before 3.1.
+type LegacyCodec struct {
+	Secret string
+	// Fallbacks are other secrets accepted when decoding, see
+	// SessionOptions.SecretFallbacks.
+	Fallbacks []string
+	// InsecureSkipVerify accepts data even if its hash is wrong.
+	InsecureSkipVerify bool
+}
+
+func (c *LegacyCodec) hashData(secret string, data []byte) string {
+	// django < 3.1 uses "django.contrib.sessions" + class name, with no dot.
+	salt := "django.contrib.sessionsSessionStore"
+
+	return hex.EncodeToString(signing.SaltedHMAC(sha1.New, salt, secret, data))
+}
+
+func (c *LegacyCodec) checkHash(hash []byte, data []byte) bool {
+	for _, secret := range append([]string{c.Secret}, c.Fallbacks...) {
+		if hmac.Equal(hash, []byte(c.hashData(secret, data))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *LegacyCodec) Encode(m map[string]json.RawMessage) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	str := []byte(c.hashData(c.Secret, data) + ":")
+	str = append(str, data...)
+	return base64.StdEncoding.EncodeToString(str), nil
+}
+
+func (c *LegacyCodec) Decode(sdata string) (map[string]json.RawMessage, error) {
+	data, err := base64.StdEncoding.DecodeString(sdata)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	split := strings.SplitN(string(data), ":", 2)
+	if len(split) != 2 {
+		return nil, errors.New("session data is not in legacy format")
+	}
+	hash := []byte(split[0])
+	jdata := []byte(split[1])
+
+	if !c.checkHash(hash, jdata) && !c.InsecureSkipVerify {
+		return nil, errors.Trace(ErrBadSignature)
+	}
+
+	m := make(map[string]json.RawMessage)
+	err = json.Unmarshal(jdata, &m)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return m, nil
+}
+
+// SigningCodec reads and writes the django.core.signing.dumps() format used by
+// django 3.1 and later: a base64 json payload, zlib compressed and prefixed
+// with "." when that makes it smaller, followed by a base62 timestamp and a
+// salted HMAC-SHA256 signature.
+type SigningCodec struct {
+	Secret string
+	// Fallbacks are other secrets accepted when decoding, see
+	// SessionOptions.SecretFallbacks.
+	Fallbacks []string
+	// InsecureSkipVerify accepts data even if its signature is wrong.
+	InsecureSkipVerify bool
+	// Salt defaults to "django.contrib.sessions.SessionStore", which is what
+	// the db and cached_db backends of django use.
+	Salt string
+}
+
+func (c *SigningCodec) signer() *signing.TimestampSigner {
+	salt := c.Salt
+	if salt == "" {
+		salt = "django.contrib.sessions.SessionStore"
+	}
+
+	return &signing.TimestampSigner{Signer: signing.Signer{
+		Key: c.Secret, FallbackKeys: c.Fallbacks, Salt: salt,
+	}}
+}
+
+func (c *SigningCodec) Encode(m map[string]json.RawMessage) (string, error) {
+	sdata, err := c.signer().SignObject(m, true)
+	return sdata, errors.Trace(err)
+}
+
+func (c *SigningCodec) Decode(sdata string) (map[string]json.RawMessage, error) {
+	signer := c.signer()
+
+	if c.InsecureSkipVerify {
+		// replace whatever signature is there with a valid one.
+		if idx := strings.LastIndex(sdata, ":"); idx != -1 {
+			resigned, err := signer.Signer.Sign(sdata[:idx])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			sdata = resigned
+		}
+	}
+
+	// django does not pass max_age for sessions, expiry is handled by
+	// django_session.expire_date.
+	m := make(map[string]json.RawMessage)
+	err := signer.UnsignObject(sdata, &m, 0)
+	if err != nil {
+		if errors.Cause(err) == signing.ErrBadSignature {
+			return nil, errors.Wrap(err, ErrBadSignature)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	return m, nil
+}
+
+// multiCodec encodes with encoder and decodes with the first of decoders that
+// succeeds, so session data written by several django versions can be read. If
+// none succeed and any of them rejected the signature, ErrBadSignature is
+// returned.
+type multiCodec struct {
+	encoder  SessionCodec
+	decoders []SessionCodec
+}
+
+func (c *multiCodec) Encode(m map[string]json.RawMessage) (string, error) {
+	s, err := c.encoder.Encode(m)
+	return s, errors.Trace(err)
+}
+
+func (c *multiCodec) Decode(sdata string) (map[string]json.RawMessage, error) {
+	var err, sigErr error
+	for _, d := range c.decoders {
+		var m map[string]json.RawMessage
+		m, err = d.Decode(sdata)
+		if err == nil {
+			return m, nil
+		}
+		if errors.Cause(err) == ErrBadSignature {
+			sigErr = err
+		}
+	}
+	if sigErr != nil {
+		return nil, errors.Trace(sigErr)
+	}
+	return nil, errors.Trace(err)
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// defaultPermissions are django's Options.default_permissions.
+var defaultPermissions = []string{"add", "change", "delete", "view"}
+
+func (s *astore) CreateGroup(
+	ctx context.Context, name string,
+) (django.Group, error) {
+	query := "INSERT INTO " + s.GroupTable + " (name) VALUES ($1) RETURNING id"
+	id, err := amalgam.QueryIntoInt(ctx, query, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	amalgam.LOGGER.Info("group_created", "group", id, "name", name)
+	return &group{DId: int64(id), DName: name, store: s}, nil
+}
+
+func (s *astore) RenameGroup(
+	ctx context.Context, groupID int64, name string,
+) error {
+	tx, err := amalgam.Ctx2Tx(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	result, err := tx.Exec(
+		"UPDATE "+s.GroupTable+" SET name = $1 WHERE id = $2", name, groupID,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rows == 0 {
+		return errors.Annotatef(sql.ErrNoRows, "group %d", groupID)
+	}
+
+	return nil
+}
+
+// link adds the row (a, b) to a many to many table, django makes the pair
+// unique so a link that exists is left alone.
+func link(ctx context.Context, table, columnA, columnB string, a, b int64) error {
+	query := "INSERT INTO " + table + " (" + columnA + ", " + columnB +
+		") VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	return errors.Trace(amalgam.Exec(ctx, query, a, b))
+}
+
+func unlink(ctx context.Context, table, columnA, columnB string, a, b int64) error {
+	query := "DELETE FROM " + table + " WHERE " + columnA + " = $1 AND " +
+		columnB + " = $2"
+	return errors.Trace(amalgam.Exec(ctx, query, a, b))
+}
+
+func (s *astore) AddUserToGroup(ctx context.Context, userID, groupID int64) error {
+	return errors.Trace(
+		link(ctx, s.UserGroupsTable, "user_id", "group_id", userID, groupID),
+	)
+}
+
+func (s *astore) RemoveUserFromGroup(
+	ctx context.Context, userID, groupID int64,
+) error {
+	return errors.Trace(
+		unlink(ctx, s.UserGroupsTable, "user_id", "group_id", userID, groupID),
+	)
+}
+
+func (s *astore) GrantGroupPermission(
+	ctx context.Context, groupID, permissionID int64,
+) error {
+	return errors.Trace(link(
+		ctx, s.GroupPermissionsTable, "group_id", "permission_id",
+		groupID, permissionID,
+	))
+}
+
+func (s *astore) RevokeGroupPermission(
+	ctx context.Context, groupID, permissionID int64,
+) error {
+	return errors.Trace(unlink(
+		ctx, s.GroupPermissionsTable, "group_id", "permission_id",
+		groupID, permissionID,
+	))
+}
+
+func (s *astore) GrantUserPermission(
+	ctx context.Context, userID, permissionID int64,
+) error {
+	return errors.Trace(link(
+		ctx, s.UserPermissionsTable, "user_id", "permission_id",
+		userID, permissionID,
+	))
+}
+
+func (s *astore) RevokeUserPermission(
+	ctx context.Context, userID, permissionID int64,
+) error {
+	return errors.Trace(unlink(
+		ctx, s.UserPermissionsTable, "user_id", "permission_id",
+		userID, permissionID,
+	))
+}
+
+// EnsurePermissions names default permissions "Can add <model>" and so on,
+// django uses the verbose name of the model instead, pass names to match it.
+func (s *astore) EnsurePermissions(
+	ctx context.Context, appLabel, model string, names map[string]string,
+) ([]django.Permission, error) {
+	if len(names) == 0 {
+		names = map[string]string{}
+		for _, action := range defaultPermissions {
+			names[action+"_"+model] = "Can " + action + " " + model
+		}
+	}
+
+	err := amalgam.Exec(
+		ctx, "INSERT INTO "+s.ContentTypeTable+" (app_label, model) "+
+			"VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		appLabel, model,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ctid, err := amalgam.QueryIntoInt(
+		ctx, "SELECT id FROM "+s.ContentTypeTable+
+			" WHERE app_label = $1 AND model = $2",
+		appLabel, model,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	codenames := []string{}
+	for codename := range names {
+		codenames = append(codenames, codename)
+	}
+	sort.Strings(codenames)
+
+	for _, codename := range codenames {
+		err := amalgam.Exec(
+			ctx, "INSERT INTO "+s.PermissionTable+
+				" (name, content_type_id, codename) VALUES ($1, $2, $3) "+
+				"ON CONFLICT DO NOTHING",
+			names[codename], ctid, codename,
+		)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	perms, err := s.queryPermissions(
+		ctx, s.permissionQuery("WHERE p.content_type_id = $1"), ctid,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return toPermissions(perms), nil
+}
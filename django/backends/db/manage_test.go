@@ -0,0 +1,378 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// authSchema is the part of django's auth and contenttypes tables the store
+// uses. The tables are temporary, so they shadow any real ones and go away
+// with the transaction.
+var authSchema = []string{
+	`CREATE TEMP TABLE django_content_type (
+		id serial PRIMARY KEY,
+		app_label varchar(100) NOT NULL,
+		model varchar(100) NOT NULL,
+		UNIQUE (app_label, model)
+	)`,
+	`CREATE TEMP TABLE auth_permission (
+		id serial PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		content_type_id integer NOT NULL,
+		codename varchar(100) NOT NULL,
+		UNIQUE (content_type_id, codename)
+	)`,
+	`CREATE TEMP TABLE auth_group (
+		id serial PRIMARY KEY,
+		name varchar(150) NOT NULL UNIQUE
+	)`,
+	`CREATE TEMP TABLE auth_user (
+		id serial PRIMARY KEY,
+		password varchar(128) NOT NULL DEFAULT '',
+		last_login timestamptz,
+		is_superuser boolean NOT NULL DEFAULT false,
+		username varchar(150) NOT NULL UNIQUE,
+		first_name varchar(150) NOT NULL DEFAULT '',
+		last_name varchar(150) NOT NULL DEFAULT '',
+		email varchar(254) NOT NULL DEFAULT '',
+		is_staff boolean NOT NULL DEFAULT false,
+		is_active boolean NOT NULL DEFAULT true,
+		date_joined timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TEMP TABLE auth_user_groups (
+		id bigserial PRIMARY KEY,
+		user_id integer NOT NULL,
+		group_id integer NOT NULL,
+		UNIQUE (user_id, group_id)
+	)`,
+	`CREATE TEMP TABLE auth_group_permissions (
+		id bigserial PRIMARY KEY,
+		group_id integer NOT NULL,
+		permission_id integer NOT NULL,
+		UNIQUE (group_id, permission_id)
+	)`,
+	`CREATE TEMP TABLE auth_user_user_permissions (
+		id bigserial PRIMARY KEY,
+		user_id integer NOT NULL,
+		permission_id integer NOT NULL,
+		UNIQUE (user_id, permission_id)
+	)`,
+	`CREATE TEMP TABLE django_admin_log (
+		id serial PRIMARY KEY,
+		action_time timestamptz NOT NULL,
+		object_id text,
+		object_repr varchar(200) NOT NULL,
+		action_flag smallint NOT NULL,
+		change_message text NOT NULL,
+		content_type_id integer,
+		user_id integer NOT NULL
+	)`,
+}
+
+// testAuthStore returns an AuthStore on the auth schema and a context with a
+// transaction that is rolled back after the test. The tests need postgres,
+// they are skipped unless AMALGAM_TEST_DSN has a lib/pq connection string.
+func testAuthStore(t *testing.T) (context.Context, django.AuthStore) {
+	dsn := os.Getenv("AMALGAM_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AMALGAM_TEST_DSN not set")
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+		db.Close()
+	})
+
+	for _, query := range authSchema {
+		if _, err := tx.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), amalgam.KeyDBTransaction, tx)
+	ctx = context.WithValue(ctx, amalgam.KeyDB, db)
+
+	store, err := NewAuthStore(ctx)
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	return ctx, store
+}
+
+// createUser inserts a user named username and loads it with ctx.
+func createUser(
+	t *testing.T, ctx context.Context, store django.AuthStore, username string,
+) django.User {
+	id, err := amalgam.QueryIntoInt(
+		ctx, "INSERT INTO auth_user (username) VALUES ($1) RETURNING id",
+		username,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.UserByID(ctx, int64(id))
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	return u
+}
+
+func count(t *testing.T, ctx context.Context, table string) int {
+	n, err := amalgam.QueryIntoInt(ctx, "SELECT count(*) FROM "+table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAuthTablesDefaults(t *testing.T) {
+	// GroupTable used to be defaulted only when UserTable was empty.
+	at := AuthTables{UserTable: "accounts_user"}
+	updateAuthTablesWithDefault(&at)
+	if at.UserTable != "accounts_user" || at.GroupTable != "auth_group" {
+		t.Fatalf("UserTable = %s, GroupTable = %s", at.UserTable, at.GroupTable)
+	}
+
+	at = AuthTables{GroupTable: "accounts_team"}
+	updateAuthTablesWithDefault(&at)
+	if at.GroupTable != "accounts_team" || at.UserTable != "auth_user" {
+		t.Fatalf("UserTable = %s, GroupTable = %s", at.UserTable, at.GroupTable)
+	}
+}
+
+func TestCreateAndRenameGroup(t *testing.T) {
+	ctx, store := testAuthStore(t)
+
+	g, err := store.CreateGroup(ctx, "editors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID() == 0 || g.Name() != "editors" {
+		t.Fatalf("created %d %s", g.ID(), g.Name())
+	}
+
+	if err := store.RenameGroup(ctx, g.ID(), "writers"); err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := store.GroupByID(ctx, g.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name() != "writers" {
+		t.Fatalf("name = %s, want writers", renamed.Name())
+	}
+
+	err = store.RenameGroup(ctx, g.ID()+1000, "nobody")
+	if errors.Cause(err) != sql.ErrNoRows {
+		t.Fatalf("renaming a missing group: %v", err)
+	}
+}
+
+func TestLinksAreIdempotent(t *testing.T) {
+	ctx, store := testAuthStore(t)
+
+	g, err := store.CreateGroup(ctx, "editors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := store.EnsurePermissions(ctx, "blog", "article", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const userID = 7
+	permID := perms[0].ID()
+
+	cases := []struct {
+		table        string
+		link, unlink func() error
+	}{
+		{
+			"auth_user_groups",
+			func() error { return store.AddUserToGroup(ctx, userID, g.ID()) },
+			func() error { return store.RemoveUserFromGroup(ctx, userID, g.ID()) },
+		},
+		{
+			"auth_group_permissions",
+			func() error { return store.GrantGroupPermission(ctx, g.ID(), permID) },
+			func() error { return store.RevokeGroupPermission(ctx, g.ID(), permID) },
+		},
+		{
+			"auth_user_user_permissions",
+			func() error { return store.GrantUserPermission(ctx, userID, permID) },
+			func() error { return store.RevokeUserPermission(ctx, userID, permID) },
+		},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 2; i++ {
+			if err := c.link(); err != nil {
+				t.Fatalf("%s: link %d: %v", c.table, i, err)
+			}
+		}
+		if n := count(t, ctx, c.table); n != 1 {
+			t.Fatalf("%s: %d rows after linking twice", c.table, n)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := c.unlink(); err != nil {
+				t.Fatalf("%s: unlink %d: %v", c.table, i, err)
+			}
+		}
+		if n := count(t, ctx, c.table); n != 0 {
+			t.Fatalf("%s: %d rows after unlinking twice", c.table, n)
+		}
+	}
+}
+
+func TestEnsurePermissions(t *testing.T) {
+	ctx, store := testAuthStore(t)
+
+	perms, err := store.EnsurePermissions(ctx, "blog", "article", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"blog.add_article", "blog.change_article",
+		"blog.delete_article", "blog.view_article",
+	}
+	if len(perms) != len(want) {
+		t.Fatalf("got %d permissions, want %d", len(perms), len(want))
+	}
+	for i, p := range perms {
+		if django.PermissionString(p) != want[i] {
+			t.Errorf(
+				"permission %d = %s, want %s",
+				i, django.PermissionString(p), want[i],
+			)
+		}
+	}
+	if perms[0].Name() != "Can add article" {
+		t.Errorf("name = %s", perms[0].Name())
+	}
+
+	// running it again, with one more permission, keeps what exists.
+	perms, err = store.EnsurePermissions(ctx, "blog", "article", map[string]string{
+		"add_article":     "Can add article",
+		"publish_article": "Can publish article",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perms) != len(want)+1 {
+		t.Fatalf("got %d permissions, want %d", len(perms), len(want)+1)
+	}
+	if n := count(t, ctx, "django_content_type"); n != 1 {
+		t.Fatalf("%d content types", n)
+	}
+
+	perm, err := store.PermissionByCode(ctx, "blog.publish_article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm.Name() != "Can publish article" {
+		t.Errorf("name = %s", perm.Name())
+	}
+}
+
+func TestSaveNeedsActor(t *testing.T) {
+	ctx, store := testAuthStore(t)
+	admin := createUser(t, ctx, store, "admin")
+
+	u := createUser(t, ctx, store, "jdoe")
+	err := u.SetName("Jane Doe", true)
+	if errors.Cause(err) != django.ErrNoUser {
+		t.Fatalf("saving without an actor: %v", err)
+	}
+	if n := count(t, ctx, "django_admin_log"); n != 0 {
+		t.Fatalf("%d log entries", n)
+	}
+	if err := u.RefreshFromDB(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := u.Field("first_name"); name != "" {
+		t.Fatalf("first_name = %v, saved without an actor", name)
+	}
+
+	u, err = store.UserByID(django.WithActor(ctx, admin), u.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetName("Jane Doe", true); err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	actor, err := amalgam.QueryIntoInt(ctx, "SELECT user_id FROM django_admin_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(actor) != admin.ID() {
+		t.Fatalf("logged as %d, want %d", actor, admin.ID())
+	}
+}
+
+func TestGrantsShowAfterRefresh(t *testing.T) {
+	ctx, store := testAuthStore(t)
+	u := createUser(t, ctx, store, "jdoe")
+
+	g, err := store.CreateGroup(ctx, "editors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := store.EnsurePermissions(ctx, "blog", "article", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read once, so they are cached.
+	if roles, err := u.Roles(); err != nil || len(roles) != 0 {
+		t.Fatalf("Roles() = %v, %v", roles, err)
+	}
+	if has, err := u.HasPermission("blog.add_article"); err != nil || has {
+		t.Fatalf("HasPermission() = %v, %v", has, err)
+	}
+
+	if err := store.AddUserToGroup(ctx, u.ID(), g.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GrantGroupPermission(ctx, g.ID(), perms[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := u.Roles(); len(roles) != 0 {
+		t.Fatalf("cached roles changed to %v", roles)
+	}
+	if has, _ := u.HasRole(ctx, g.ID()); has {
+		t.Fatal("HasRole() does not use the cached groups")
+	}
+
+	if err := u.RefreshFromDB(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := u.Roles(); err != nil || len(roles) != 1 ||
+		roles[0] != "editors" {
+		t.Errorf("Roles() = %v, %v", roles, err)
+	}
+	if has, err := u.HasRole(ctx, g.ID()); err != nil || !has {
+		t.Errorf("HasRole(%d) = %v, %v", g.ID(), has, err)
+	}
+	if has, err := u.HasRole(ctx, g.ID()+1); err != nil || has {
+		t.Errorf("HasRole(%d) = %v, %v", g.ID()+1, has, err)
+	}
+	if has, err := u.HasPermission("blog.add_article"); err != nil || !has {
+		t.Errorf("HasPermission() = %v, %v", has, err)
+	}
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam/django"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+)
+
+// AbstractUser has the columns of django's auth_user. Embed it in the struct
+// of a custom user model that extends AbstractUser.
+type AbstractUser struct {
+	ID          int64      `db:"id"`
+	Password    string     `db:"password"`
+	LastLogin   *time.Time `db:"last_login"`
+	IsSuperuser bool       `db:"is_superuser"`
+	Username    string     `db:"username"`
+	FirstName   string     `db:"first_name"`
+	LastName    string     `db:"last_name"`
+	Email       string     `db:"email"`
+	IsStaff     bool       `db:"is_staff"`
+	IsActive    bool       `db:"is_active"`
+	DateJoined  time.Time  `db:"date_joined"`
+}
+
+// NewAbstractUser returns an AbstractUser with django's defaults.
+func NewAbstractUser() interface{} {
+	return &AbstractUser{IsActive: true, DateJoined: time.Now()}
+}
+
+// UserModel describes the struct users are loaded into, like
+// AUTH_USER_MODEL. Struct fields map to columns of AuthTables.UserTable the
+// way sqlx maps them, by db tag or else by lower cased name, so the struct
+// must not have fields for columns the table does not have.
+type UserModel struct {
+	// New returns a pointer to a new struct with the values new users get,
+	// it defaults to NewAbstractUser. The struct must have an int64 "id".
+	New func() interface{}
+	// UsernameField is USERNAME_FIELD, defaults to "username".
+	UsernameField string
+	// EmailField is EMAIL_FIELD, defaults to "email" if the model has it.
+	EmailField string
+	// PhoneField is the column UserByPhone() and GetOrCreateUser() look
+	// users up by, by default there is none.
+	PhoneField string
+	// ConcurrencyField turns on optimistic locking, Save() fails with
+	// django.ErrConflict if the column changed since the user was loaded. An
+	// integer column is incremented on every save, a time column is set to
+	// the time of the save.
+	ConcurrencyField string
+	// ContentType is the "app_label.model" of the user model, for
+	// django_admin_log entries. Defaults to "auth.user".
+	ContentType string
+}
+
+// Model returns the struct user was loaded into, a pointer of the type
+// UserModel.New returns, or nil if user was not loaded by this package.
+func Model(du django.User) interface{} {
+	u, ok := du.(*user)
+	if !ok {
+		return nil
+	}
+	return u.model
+}
+
+var errNoSuchField = errors.New("no such field in user model")
+
+// userModel is UserModel along with the columns of its struct.
+type userModel struct {
+	UserModel
+	typ     reflect.Type
+	columns []string
+	fields  map[string]*reflectx.FieldInfo
+}
+
+func newUserModel(m UserModel) (*userModel, error) {
+	if m.New == nil {
+		m.New = NewAbstractUser
+	}
+
+	typ := reflect.TypeOf(m.New())
+	if typ == nil || typ.Kind() != reflect.Ptr ||
+		typ.Elem().Kind() != reflect.Struct {
+		return nil, errors.Errorf(
+			"user model must be a pointer to a struct, not %v", typ,
+		)
+	}
+
+	um := &userModel{
+		UserModel: m, typ: typ.Elem(),
+		fields: map[string]*reflectx.FieldInfo{},
+	}
+
+	mapper := reflectx.NewMapperFunc("db", sqlx.NameMapper)
+	for _, fi := range mapper.TypeMap(um.typ).Index {
+		// nested structs like sql.NullString are a single column.
+		if fi.Embedded || strings.Contains(fi.Path, ".") {
+			continue
+		}
+		if _, ok := um.fields[fi.Path]; ok {
+			continue
+		}
+		um.fields[fi.Path] = fi
+		um.columns = append(um.columns, fi.Path)
+	}
+
+	if id, ok := um.fields["id"]; !ok || id.Field.Type.Kind() != reflect.Int64 {
+		return nil, errors.Errorf("user model %v has no int64 id", um.typ)
+	}
+
+	if um.UsernameField == "" {
+		um.UsernameField = "username"
+	}
+	if um.ContentType == "" {
+		um.ContentType = "auth.user"
+	}
+	if !strings.Contains(um.ContentType, ".") {
+		return nil, errors.Errorf(
+			"content type %q is not app_label.model", um.ContentType,
+		)
+	}
+	if _, ok := um.fields["email"]; ok && um.EmailField == "" {
+		um.EmailField = "email"
+	}
+
+	names := []string{
+		um.UsernameField, um.EmailField, um.PhoneField, um.ConcurrencyField,
+	}
+	for _, name := range names {
+		if _, ok := um.fields[name]; name != "" && !ok {
+			return nil, errors.Annotatef(errNoSuchField, "%v.%s", um.typ, name)
+		}
+	}
+
+	if um.ConcurrencyField != "" {
+		if _, err := um.nextVersion(m.New()); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return um, nil
+}
+
+// quoteIdent quotes a column or a table name, which may have a schema.
+func quoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// selectColumns returns the quoted columns of the model for a SELECT.
+func (m *userModel) selectColumns() string {
+	quoted := []string{}
+	for _, c := range m.columns {
+		quoted = append(quoted, quoteIdent(c))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// field returns the struct field of column name. Nil embedded structs are
+// allocated if alloc is set, otherwise the returned value is not valid.
+func (m *userModel) field(
+	model interface{}, name string, alloc bool,
+) (reflect.Value, bool) {
+	fi, ok := m.fields[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	v := reflect.ValueOf(model).Elem()
+	for n, i := range fi.Index {
+		if n > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, true
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+
+	return v, true
+}
+
+// value returns the value of field f for database/sql, nil if it is in a nil
+// embedded struct.
+func value(f reflect.Value) interface{} {
+	if !f.IsValid() {
+		return nil
+	}
+	return f.Interface()
+}
+
+// get returns the value of column name the way database/sql would return it,
+// so nullable fields are nil or the value, never a pointer or a sql.Null*.
+func (m *userModel) get(model interface{}, name string) (interface{}, bool) {
+	v, ok := m.field(model, name, false)
+	if !ok {
+		return nil, false
+	}
+	if !v.IsValid() {
+		return nil, true
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, true
+		}
+		v = v.Elem()
+	}
+
+	if valuer, ok := v.Interface().(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return nil, true
+		}
+		return value, true
+	}
+
+	return v.Interface(), true
+}
+
+// set stores value in column name, converting it the way database/sql would
+// when scanning.
+func (m *userModel) set(model interface{}, name string, value interface{}) error {
+	f, ok := m.field(model, name, true)
+	if !ok {
+		return errors.Annotate(errNoSuchField, name)
+	}
+
+	if scanner, ok := f.Addr().Interface().(sql.Scanner); ok {
+		return errors.Annotate(scanner.Scan(value), name)
+	}
+
+	if value == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch {
+	case v.Type().AssignableTo(f.Type()):
+		f.Set(v)
+	case f.Kind() == reflect.Ptr && v.Type().AssignableTo(f.Type().Elem()):
+		p := reflect.New(f.Type().Elem())
+		p.Elem().Set(v)
+		f.Set(p)
+	case kindClass(v.Kind()) == kindClass(f.Kind()) &&
+		v.Type().ConvertibleTo(f.Type()):
+		f.Set(v.Convert(f.Type()))
+	case v.Kind() == reflect.Slice && f.Kind() == reflect.String &&
+		v.Type().Elem().Kind() == reflect.Uint8:
+		f.SetString(string(v.Bytes()))
+	default:
+		return errors.Errorf(
+			"can not set %s of type %v to %T", name, f.Type(), value,
+		)
+	}
+
+	return nil
+}
+
+// kindClass groups kinds that convert into each other without surprises,
+// unlike say int to string.
+func kindClass(k reflect.Kind) reflect.Kind {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int64
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return reflect.Uint64
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	}
+	return k
+}
+
+// snapshot returns the values of all columns, to find what changed later.
+func (m *userModel) snapshot(model interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, c := range m.columns {
+		values[c], _ = m.get(model, c)
+	}
+	return values
+}
+
+// changed returns the columns whose values differ from snapshot.
+func (m *userModel) changed(
+	model interface{}, snapshot map[string]interface{},
+) []string {
+	columns := []string{}
+	for _, c := range m.columns {
+		v, _ := m.get(model, c)
+		if !sameValue(v, snapshot[c]) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Equal(b)
+	case []byte:
+		b, ok := b.([]byte)
+		return ok && bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// nextVersion returns the value ConcurrencyField gets on the next save.
+func (m *userModel) nextVersion(model interface{}) (interface{}, error) {
+	f, _ := m.field(model, m.ConcurrencyField, true)
+
+	switch f.Interface().(type) {
+	case time.Time, *time.Time:
+		// postgres keeps microseconds, the value must compare equal later.
+		return time.Now().Truncate(time.Microsecond), nil
+	}
+
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int() + 1, nil
+	}
+
+	return nil, errors.Errorf(
+		"concurrency field %s must be an integer or a time, not %v",
+		m.ConcurrencyField, f.Type(),
+	)
+}
+
+// values returns the values of columns in model, for an INSERT or UPDATE.
+func (m *userModel) values(model interface{}, columns []string) []interface{} {
+	values := []interface{}{}
+	for _, c := range columns {
+		f, _ := m.field(model, c, false)
+		values = append(values, value(f))
+	}
+	return values
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,14 +2,9 @@ package db
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
-	"encoding/hex"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/amitu/amalgam"
@@ -26,11 +21,63 @@ var (
 	`
 )
 
-// NewSessionStore creates a session store. It verifies that the session related
-// table exists (but not if the table schema is correct).
-func NewSessionStore(
-	ctx context.Context, secret string, auth django.AuthStore,
+// SessionOptions configure a session store created by NewCustomSessionStore.
+type SessionOptions struct {
+	Secret string
+	// SecretFallbacks are accepted in addition to Secret when verifying session
+	// data, like django's SECRET_KEY_FALLBACKS. Data is always signed with
+	// Secret, so old secrets can be dropped once sessions have been rewritten.
+	SecretFallbacks []string
+	// InsecureSkipVerify disables signature verification of the default
+	// decoders. Tampered data is then accepted, only use this while moving to
+	// a new secret without the old one at hand.
+	InsecureSkipVerify bool
+	// Encoder is used to write session_data. It defaults to LegacyCodec, so
+	// sessions stay readable by django < 3.1, use SigningCodec once all django
+	// services are on 3.1 or later.
+	Encoder SessionCodec
+	// Decoders are tried in order to read session_data. They default to
+	// SigningCodec followed by LegacyCodec, like django 3.1 does.
+	Decoders []SessionCodec
+	// CookieAge is django's SESSION_COOKIE_AGE, sessions expire this long
+	// after they were last saved. Defaults to
+	// amalgam.SessionCookieAge.
+	CookieAge time.Duration
+	// ClearBatchSize is the number of rows ClearExpired() deletes per
+	// statement. Defaults to 1000.
+	ClearBatchSize int
+}
+
+func updateSessionOptionsWithDefault(so *SessionOptions) {
+	if so.CookieAge == 0 {
+		so.CookieAge = time.Second * time.Duration(amalgam.SessionCookieAge)
+	}
+	if so.ClearBatchSize == 0 {
+		so.ClearBatchSize = 1000
+	}
+	if so.Encoder == nil {
+		so.Encoder = &LegacyCodec{Secret: so.Secret}
+	}
+	if len(so.Decoders) == 0 {
+		so.Decoders = []SessionCodec{
+			&SigningCodec{
+				Secret: so.Secret, Fallbacks: so.SecretFallbacks,
+				InsecureSkipVerify: so.InsecureSkipVerify,
+			},
+			&LegacyCodec{
+				Secret: so.Secret, Fallbacks: so.SecretFallbacks,
+				InsecureSkipVerify: so.InsecureSkipVerify,
+			},
+		}
+	}
+}
+
+// NewCustomSessionStore creates a session store. It verifies that the session
+// related table exists (but not if the table schema is correct).
+func NewCustomSessionStore(
+	ctx context.Context, auth django.AuthStore, options SessionOptions,
 ) (django.SessionStore, error) {
+	updateSessionOptionsWithDefault(&options)
 	count, err := amalgam.QueryIntoInt(
 		ctx, "SELECT count(*) FROM django_session",
 	)
@@ -39,14 +86,36 @@ func NewSessionStore(
 	}
 
 	amalgam.LOGGER.Debug("found_session_table", "count", count)
-	return &store{secret: secret, auth: auth}, nil
+	return &store{
+		secret:  options.Secret,
+		auth:    auth,
+		codec:   &multiCodec{options.Encoder, options.Decoders},
+		options: options,
+	}, nil
+}
+
+// NewSessionStore creates a session store with default SessionOptions.
+func NewSessionStore(
+	ctx context.Context, secret string, auth django.AuthStore,
+) (django.SessionStore, error) {
+	return NewCustomSessionStore(ctx, auth, SessionOptions{Secret: secret})
 }
 
 type store struct {
-	secret string
-	auth   django.AuthStore
+	secret  string
+	auth    django.AuthStore
+	codec   SessionCodec
+	options SessionOptions
 }
 
+func (s *store) expiryDate() time.Time {
+	return time.Now().Add(s.options.CookieAge)
+}
+
+// GetSessionBySessionKey returns sql.ErrNoRows for expired sessions, like it
+// does for sessions that do not exist. The session returned along with
+// sql.ErrNoRows is empty and has no key, so a key chosen by the client is never
+// saved.
 func (s *store) GetSessionBySessionKey(
 	ctx context.Context, id string,
 ) (django.Session, error) {
@@ -55,10 +124,26 @@ func (s *store) GetSessionBySessionKey(
 	ss.dDataCache = make(map[string]json.RawMessage)
 	ss.DSessionKey = id
 
-	err := amalgam.QueryIntoStruct(
-		ctx, &ss, `SELECT * FROM django_session WHERE session_key = $1`, id,
-	)
+	query := `
+		SELECT * FROM django_session WHERE session_key = $1 AND expire_date > $2
+	`
+	args := []interface{}{id, time.Now()}
+	// with SESSION_SAVE_EVERY_REQUEST the expiry is pushed back every time the
+	// session is loaded.
+	if amalgam.SessionSaveEveryRequest {
+		query = `
+			UPDATE django_session SET expire_date = $3
+			WHERE session_key = $1 AND expire_date > $2
+			RETURNING *
+		`
+		args = append(args, s.expiryDate())
+	}
+
+	err := amalgam.QueryIntoStruct(ctx, &ss, query, args...)
 	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			ss.DSessionKey = ""
+		}
 		return &ss, errors.Trace(err)
 	}
 	ss.dDataCache = nil
@@ -66,24 +151,63 @@ func (s *store) GetSessionBySessionKey(
 	return &ss, nil
 }
 
-func (s *store) CreateSession(ctx context.Context) (django.Session, error) {
-	session_key := amalgam.GetRandomString(32)
-	expire_date := time.Now().Add(time.Hour * 24 * 3600)
+func newSessionKey() string {
+	return amalgam.GetSecureRandomString(32)
+}
 
+// CreateSession returns an empty session without touching the database, like
+// django the session gets a key and a row in django_session when a value is
+// first set in it.
+func (s *store) CreateSession(_ context.Context) (django.Session, error) {
 	ss := session{}
-	ss.DSessionKey = session_key
-	ss.DExpireDate = expire_date
+	ss.DExpireDate = s.expiryDate()
 	ss.store = s
 	ss.dDataCache = make(map[string]json.RawMessage)
 
-	err := ss.Save(ctx, true)
+	return &ss, nil
+}
+
+// ClearExpired deletes expired sessions, like django's clearsessions
+// management command. Rows are deleted in batches of
+// SessionOptions.ClearBatchSize, each batch runs outside the transaction in ctx
+// so that locks are released as it goes. It returns the number of deleted
+// sessions.
+func (s *store) ClearExpired(ctx context.Context) (int64, error) {
+	db, err := amalgam.Ctx2Db(ctx)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return 0, errors.Trace(err)
 	}
 
-	amalgam.LOGGER.Debug("Session Saved: ", ss.SessionKey())
+	query := `
+		DELETE FROM django_session
+		WHERE session_key IN (
+			SELECT session_key FROM django_session
+			WHERE expire_date < $1
+			LIMIT $2
+		)
+	`
 
-	return &ss, nil
+	now := time.Now()
+	total := int64(0)
+	for {
+		result, err := db.ExecContext(ctx, query, now, s.options.ClearBatchSize)
+		if err != nil {
+			return total, errors.Trace(err)
+		}
+
+		num, err := result.RowsAffected()
+		if err != nil {
+			return total, errors.Trace(err)
+		}
+		total += num
+
+		if num < int64(s.options.ClearBatchSize) {
+			break
+		}
+	}
+
+	amalgam.LOGGER.Debug("cleared_expired_sessions", "count", total)
+	return total, nil
 }
 
 func (s *store) DestroySession(ctx context.Context, id string) error {
@@ -91,10 +215,14 @@ func (s *store) DestroySession(ctx context.Context, id string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	_, err = tx.Exec("DELETE FROM django_session WHERE session_key=?", id)
+	_, err = tx.Exec("DELETE FROM django_session WHERE session_key = $1", id)
 	return errors.Trace(err)
 }
 
+func (s *store) SessionAuthHash(user django.User) string {
+	return django.SessionAuthHash(user, s.options.Secret)
+}
+
 type session struct {
 	DSessionKey string    `db:"session_key"`
 	DExpireDate time.Time `db:"expire_date"`
@@ -105,12 +233,8 @@ type session struct {
 }
 
 func (s *session) String() string {
-	if s.dDataCache == nil {
-		dDataCache, err := s.loadSessionData()
-		if err != nil {
-			return errors.ErrorStack(err)
-		}
-		s.dDataCache = dDataCache
+	if err := s.load(); err != nil {
+		return errors.ErrorStack(err)
 	}
 
 	return fmt.Sprintf(
@@ -118,42 +242,37 @@ func (s *session) String() string {
 	)
 }
 
-func (s *session) hashData(data []byte) []byte {
-	salt := "django.contrib.sessions.SessionStore"
-
-	key := sha1.Sum([]byte(salt + s.store.secret))
-
-	mac := hmac.New(sha1.New, key[:])
-	mac.Write(data)
-
-	return mac.Sum(nil)
-}
-
-func (s *session) checkHash(mac []byte, data []byte) bool {
-	expectedMac := s.hashData(data)
-	return hmac.Equal(mac, expectedMac)
-}
-
+// loadSessionData decodes DData. Like django, data that fails verification is
+// treated as an empty session.
 func (s *session) loadSessionData() (map[string]json.RawMessage, error) {
-	data, err := base64.StdEncoding.DecodeString(s.DData)
+	m, err := s.store.codec.Decode(s.DData)
 	if err != nil {
-		return nil, errors.Trace(err)
+		if errors.Cause(err) != ErrBadSignature {
+			return nil, errors.Trace(err)
+		}
+
+		amalgam.LOGGER.Warn(
+			"session_data_tampered", "sessionkey", s.DSessionKey,
+		)
+		amalgam.Counter("session_data_tampered", 1, 1)
+		return make(map[string]json.RawMessage), nil
 	}
-	split := strings.SplitN(string(data), ":", 2)
-	hash := []byte(split[0])
-	jdata := []byte(split[1])
 
-	if !s.checkHash(hash, jdata) && false {
-		return nil, errors.New("hash is incorrect won't parse session data")
+	return m, nil
+}
+
+// load decodes DData into dDataCache, unless that was done already.
+func (s *session) load() error {
+	if s.dDataCache != nil {
+		return nil
 	}
 
-	m := make(map[string]json.RawMessage)
-	err = json.Unmarshal([]byte(jdata), &m)
+	dDataCache, err := s.loadSessionData()
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
 	}
-
-	return m, nil
+	s.dDataCache = dDataCache
+	return nil
 }
 
 func (s *session) SessionKey() string {
@@ -168,8 +287,8 @@ func (s *session) SetValue(
 		return errors.Trace(err)
 	}
 	amalgam.LOGGER.Debug("session_set_value", "value", svalue)
-	if s.dDataCache == nil {
-		s.dDataCache = make(map[string]json.RawMessage)
+	if err := s.load(); err != nil {
+		return errors.Trace(err)
 	}
 
 	s.dDataCache[key] = json.RawMessage(svalue)
@@ -178,17 +297,16 @@ func (s *session) SetValue(
 }
 
 func (s *session) DeleteValue(ctx context.Context, key string) error {
+	if err := s.load(); err != nil {
+		return errors.Trace(err)
+	}
 	delete(s.dDataCache, key)
 	return errors.Trace(s.Save(ctx, false))
 }
 
 func (s *session) GetValue(key string) ([]byte, error) {
-	if s.dDataCache == nil {
-		dDataCache, err := s.loadSessionData()
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		s.dDataCache = dDataCache
+	if err := s.load(); err != nil {
+		return nil, errors.Trace(err)
 	}
 
 	v, ok := s.dDataCache[key]
@@ -235,60 +353,67 @@ func (s *session) Destroy(ctx context.Context) error {
 	return s.store.DestroySession(ctx, s.DSessionKey)
 }
 
+func (s *session) CycleKey(ctx context.Context) error {
+	if err := s.load(); err != nil {
+		return errors.Trace(err)
+	}
+
+	old := s.DSessionKey
+	s.DSessionKey = newSessionKey()
+	if err := s.Save(ctx, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	if old == "" {
+		return nil
+	}
+	return errors.Trace(s.store.DestroySession(ctx, old))
+}
+
+func (s *session) Flush(ctx context.Context) error {
+	old := s.DSessionKey
+	s.DSessionKey = ""
+	s.dDataCache = make(map[string]json.RawMessage)
+
+	if old == "" {
+		return nil
+	}
+	return errors.Trace(s.store.DestroySession(ctx, old))
+}
+
 func (s *session) Store() django.SessionStore {
 	return s.store
 }
 
 func (s *session) GetUser(ctx context.Context) (django.User, error) {
-	api_key := ctx.Value("api_key")
-	if api_key != nil {
-		user, err := s.store.auth.UserByAPIKey(ctx, api_key.(string))
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-
-		return user, nil
-	} else {
-		uid, err := s.GetInt64(django.KeyUserID)
-		if err != nil {
-			uid, err := s.GetString(django.KeyUserID)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			uid_int, err := strconv.ParseInt(uid, 0, 64)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			user, err := s.store.auth.UserByID(ctx, uid_int)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			return user, nil
-		}
-		user, err := s.store.auth.UserByID(ctx, uid)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-
-		return user, nil
+	user, err := django.UserFromSession(
+		ctx, s, s.store.auth,
+		s.store.options.Secret, s.store.options.SecretFallbacks,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
+
+	return user, nil
 }
 
 func (s *session) prepareForSave() error {
 	// serialize DData
-	data, err := json.Marshal(s.dDataCache)
+	data, err := s.store.codec.Encode(s.dDataCache)
 	if err != nil {
 		return errors.Trace(err)
 	}
-
-	str := []byte(hex.EncodeToString(s.hashData(data)) + ":")
-	str = append(str, data...)
-	s.DData = base64.StdEncoding.EncodeToString(str)
+	s.DData = data
 
 	return nil
 }
 
 func (s *session) Save(ctx context.Context, i bool) error {
+	// a flushed session gets a new key when something is stored in it again.
+	if s.DSessionKey == "" {
+		s.DSessionKey = newSessionKey()
+	}
+
 	err := s.prepareForSave()
 	if err != nil {
 		return errors.Trace(err)
@@ -299,9 +424,15 @@ func (s *session) Save(ctx context.Context, i bool) error {
 		return errors.Trace(err)
 	}
 
+	// like django every save pushes the expiry back.
+	s.DExpireDate = s.store.expiryDate()
+
 	result, err := tx.Exec(
-		"UPDATE django_session SET session_data = $1 WHERE session_key = $2",
-		s.DData, s.DSessionKey,
+		`
+			UPDATE django_session SET session_data = $1, expire_date = $2
+			WHERE session_key = $3
+		`,
+		s.DData, s.DExpireDate, s.DSessionKey,
 	)
 	if err != nil {
 		return errors.Trace(err)
@@ -321,6 +452,5 @@ func (s *session) Save(ctx context.Context, i bool) error {
 	} else if num > 1 {
 		return errors.New("Unexpected number of updates")
 	}
-
 	return nil
 }
@@ -49,6 +49,14 @@ func (f *fakeSessionStore) DestroySession(_ context.Context, id string) error {
 	return nil // TODO
 }
 
+func (f *fakeSessionStore) ClearExpired(_ context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeSessionStore) SessionAuthHash(user User) string {
+	return SessionAuthHash(user, amalgam.Secret)
+}
+
 func (s *session) SessionKey() string {
 	return s.id
 }
@@ -113,6 +121,23 @@ func (s *session) Destroy(context.Context) error {
 	return nil // TODO
 }
 
+func (s *session) CycleKey(context.Context) error {
+	f := s.store.(*fakeSessionStore)
+	delete(f.sessions, s.id)
+	s.id = amalgam.GetRandomString(32)
+	f.sessions[s.id] = s
+	return nil
+}
+
+func (s *session) Flush(context.Context) error {
+	f := s.store.(*fakeSessionStore)
+	delete(f.sessions, s.id)
+	s.values = make(map[string]json.RawMessage)
+	s.id = amalgam.GetRandomString(32)
+	f.sessions[s.id] = s
+	return nil
+}
+
 func (s *session) Store() SessionStore {
 	return s.store
 }
@@ -0,0 +1,166 @@
+package hashers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/amitu/amalgam"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// Argon2TimeCost, Argon2MemoryCost and Argon2Parallelism are django's
+	// defaults for new argon2 hashes.
+	Argon2TimeCost    = 2
+	Argon2MemoryCost  = 102400
+	Argon2Parallelism = 8
+	// argon2HashLength is argon2-cffi's DEFAULT_HASH_LENGTH, which django uses.
+	argon2HashLength = 16
+	argon2Version    = argon2.Version
+)
+
+// Argon2PasswordHasher is django's "argon2" hasher. New hashes use argon2id,
+// existing argon2i hashes are verified and flagged for update.
+type Argon2PasswordHasher struct {
+	TimeCost    uint32
+	MemoryCost  uint32
+	Parallelism uint8
+}
+
+func (h *Argon2PasswordHasher) Algorithm() string {
+	return "argon2"
+}
+
+func (h *Argon2PasswordHasher) params() (uint32, uint32, uint8) {
+	t, m, p := h.TimeCost, h.MemoryCost, h.Parallelism
+	if t == 0 {
+		t = Argon2TimeCost
+	}
+	if m == 0 {
+		m = Argon2MemoryCost
+	}
+	if p == 0 {
+		p = Argon2Parallelism
+	}
+	return t, m, p
+}
+
+func (h *Argon2PasswordHasher) Salt() string {
+	return salt()
+}
+
+func (h *Argon2PasswordHasher) Encode(password, salt string) (string, error) {
+	if salt == "" {
+		return "", errors.New("salt must be non empty")
+	}
+
+	t, m, p := h.params()
+	decoded := &argon2Hash{
+		variety: "argon2id", version: argon2Version,
+		memoryCost: m, timeCost: t, parallelism: p,
+		salt: []byte(salt),
+	}
+	decoded.hash = decoded.key([]byte(password), argon2HashLength)
+
+	return h.Algorithm() + decoded.String(), nil
+}
+
+func (h *Argon2PasswordHasher) Verify(password, encoded string) bool {
+	decoded, err := argon2Decode(h.Algorithm(), encoded)
+	if err != nil {
+		amalgam.LOGGER.Debug("argon2_decode_failed", "err", err)
+		return false
+	}
+
+	candidate := decoded.key([]byte(password), uint32(len(decoded.hash)))
+	return constantTimeEqual(string(candidate), string(decoded.hash))
+}
+
+func (h *Argon2PasswordHasher) MustUpdate(encoded string) bool {
+	decoded, err := argon2Decode(h.Algorithm(), encoded)
+	if err != nil {
+		return false
+	}
+
+	t, m, p := h.params()
+	return decoded.variety != "argon2id" ||
+		decoded.version != argon2Version ||
+		decoded.timeCost != t ||
+		decoded.memoryCost != m ||
+		decoded.parallelism != p
+}
+
+// HardenRuntime() does nothing, like django the work factors of argon2 are
+// not easy to equalise.
+func (h *Argon2PasswordHasher) HardenRuntime(string, string) {}
+
+type argon2Hash struct {
+	variety     string
+	version     int
+	memoryCost  uint32
+	timeCost    uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+func (a *argon2Hash) key(password []byte, length uint32) []byte {
+	if a.variety == "argon2i" {
+		return argon2.Key(
+			password, a.salt, a.timeCost, a.memoryCost, a.parallelism, length,
+		)
+	}
+	return argon2.IDKey(
+		password, a.salt, a.timeCost, a.memoryCost, a.parallelism, length,
+	)
+}
+
+// String() returns the PHC string format written by argon2-cffi.
+func (a *argon2Hash) String() string {
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		a.variety, a.version, a.memoryCost, a.timeCost, a.parallelism,
+		base64.RawStdEncoding.EncodeToString(a.salt),
+		base64.RawStdEncoding.EncodeToString(a.hash),
+	)
+}
+
+func argon2Decode(algorithm, encoded string) (*argon2Hash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != algorithm {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+
+	a := &argon2Hash{variety: parts[1]}
+	if a.variety != "argon2i" && a.variety != "argon2id" {
+		return nil, errors.Annotate(ErrBadEncoding, a.variety)
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &a.version); err != nil {
+		return nil, errors.Annotate(ErrBadEncoding, err.Error())
+	}
+	// golang.org/x/crypto/argon2 only implements version 0x13.
+	if a.version != argon2Version {
+		return nil, errors.Annotatef(
+			ErrBadEncoding, "unsupported argon2 version %d", a.version,
+		)
+	}
+
+	_, err := fmt.Sscanf(
+		parts[3], "m=%d,t=%d,p=%d", &a.memoryCost, &a.timeCost, &a.parallelism,
+	)
+	if err != nil {
+		return nil, errors.Annotate(ErrBadEncoding, err.Error())
+	}
+
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.Annotate(ErrBadEncoding, err.Error())
+	}
+	if a.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, errors.Annotate(ErrBadEncoding, err.Error())
+	}
+
+	return a, nil
+}
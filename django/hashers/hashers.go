@@ -0,0 +1,137 @@
+// Package hashers reads and writes the password hashes django stores in
+// auth_user.password, in the "algorithm$...$hash" format used by
+// django.contrib.auth.hashers.
+package hashers
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/amitu/amalgam"
+	"github.com/juju/errors"
+)
+
+const (
+	// UnusablePasswordPrefix marks a password that can never be used to log in,
+	// django writes it for users created with set_unusable_password().
+	UnusablePasswordPrefix = "!"
+	// UnusablePasswordSuffixLength is the number of random characters django
+	// appends after UnusablePasswordPrefix.
+	UnusablePasswordSuffixLength = 40
+)
+
+var (
+	ErrUnknownHasher = errors.New("unknown password hasher")
+	ErrBadEncoding   = errors.New("badly encoded password hash")
+)
+
+// Hasher is the go equivalent of django's BasePasswordHasher.
+type Hasher interface {
+	// Algorithm() returns the prefix stored before the first "$".
+	Algorithm() string
+	// Salt() returns a fresh random salt suitable for Encode().
+	Salt() string
+	// Encode() hashes password with salt and returns the full encoded string.
+	Encode(password, salt string) (string, error)
+	// Verify() returns true if password matches encoded.
+	Verify(password, encoded string) bool
+	// MustUpdate() returns true if encoded was made with stale parameters,
+	// for example a lower iteration count than the hasher now uses.
+	MustUpdate(encoded string) bool
+	// HardenRuntime() does extra work so that verifying a hash made with stale
+	// parameters takes as long as verifying a fresh one.
+	HardenRuntime(password, encoded string)
+}
+
+// PasswordHashers mirrors django's PASSWORD_HASHERS setting. The first hasher
+// is used for new passwords, the rest are only used to verify existing ones.
+var PasswordHashers = []Hasher{
+	&PBKDF2PasswordHasher{},
+	&PBKDF2SHA1PasswordHasher{},
+	&Argon2PasswordHasher{},
+	&BCryptSHA256PasswordHasher{},
+}
+
+// PreferredHasher returns the hasher used for new passwords.
+func PreferredHasher() Hasher {
+	return PasswordHashers[0]
+}
+
+// GetHasher returns the configured hasher for algorithm.
+func GetHasher(algorithm string) (Hasher, error) {
+	for _, h := range PasswordHashers {
+		if h.Algorithm() == algorithm {
+			return h, nil
+		}
+	}
+	return nil, errors.Annotate(ErrUnknownHasher, algorithm)
+}
+
+// IdentifyHasher returns the hasher that was used to create encoded.
+func IdentifyHasher(encoded string) (Hasher, error) {
+	idx := strings.Index(encoded, "$")
+	if idx == -1 {
+		return nil, errors.Trace(ErrUnknownHasher)
+	}
+	return GetHasher(encoded[:idx])
+}
+
+// IsPasswordUsable returns false for unusable ("!") or empty passwords.
+func IsPasswordUsable(encoded string) bool {
+	return encoded != "" && !strings.HasPrefix(encoded, UnusablePasswordPrefix)
+}
+
+// CheckPassword returns whether password matches encoded, and whether encoded
+// should be replaced with a fresh hash made by the preferred hasher. Callers
+// should store MakePassword(password) when both are true, this is what the
+// setter argument of django's check_password does.
+func CheckPassword(password, encoded string) (bool, bool) {
+	if !IsPasswordUsable(encoded) {
+		return false, false
+	}
+
+	preferred := PreferredHasher()
+	hasher, err := IdentifyHasher(encoded)
+	if err != nil {
+		amalgam.LOGGER.Warn("unknown_password_hasher", "err", err)
+		return false, false
+	}
+
+	hasherChanged := hasher.Algorithm() != preferred.Algorithm()
+	mustUpdate := hasherChanged || preferred.MustUpdate(encoded)
+	valid := hasher.Verify(password, encoded)
+
+	// If the hasher didn't change (we don't protect against enumeration if it
+	// does) and the password should get updated, try to close the timing gap
+	// between the work factor of the current encoded password and the default
+	// work factor.
+	if !valid && !hasherChanged && mustUpdate {
+		hasher.HardenRuntime(password, encoded)
+	}
+
+	return valid, valid && mustUpdate
+}
+
+// MakePassword returns password hashed by the preferred hasher with a fresh
+// salt.
+func MakePassword(password string) (string, error) {
+	hasher := PreferredHasher()
+	encoded, err := hasher.Encode(password, hasher.Salt())
+	return encoded, errors.Trace(err)
+}
+
+// MakeUnusablePassword returns a value that never matches any password.
+func MakeUnusablePassword() string {
+	return UnusablePasswordPrefix +
+		amalgam.GetSecureRandomString(UnusablePasswordSuffixLength)
+}
+
+// salt returns a random string with about 128 bits of entropy, like django's
+// BasePasswordHasher.salt().
+func salt() string {
+	return amalgam.GetSecureRandomString(22)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
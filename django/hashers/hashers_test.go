@@ -0,0 +1,128 @@
+package hashers
+
+import (
+	"testing"
+
+	"github.com/amitu/amalgam"
+	"github.com/inconshreveable/log15"
+)
+
+func init() {
+	amalgam.LOGGER = log15.New()
+	amalgam.LOGGER.SetHandler(log15.DiscardHandler())
+}
+
+// Hashes in the format django stores. The pbkdf2 and argon2i ones are from
+// django's own test suite, the bcrypt ones were made by libxcrypt from the
+// sha256 hex digest django passes to bcrypt.
+var djangoHashes = []struct {
+	password string
+	encoded  string
+}{
+	{
+		"lètmein",
+		"pbkdf2_sha256$1000000$seasalt$r1uLUxoxpP2Ued/qxvmje7UH9PUJBkRrvf9gGPL7Cps=",
+	},
+	{
+		"lètmein",
+		"pbkdf2_sha256$260000$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo=",
+	},
+	{
+		"lètmein",
+		"pbkdf2_sha1$1000000$seasalt2$3R9hvSAiAy5ARspAFy5GJ/2rjXo=",
+	},
+	{
+		"secret",
+		"argon2$argon2i$v=19$m=8,t=1,p=1$c2FsdHNhbHQ$YC9+jJCrQhs5R6db7LlN8Q",
+	},
+	{
+		// the argon2id vector of the argon2 reference implementation.
+		"password",
+		"argon2$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+	},
+	{
+		"lètmein",
+		"bcrypt_sha256$$2b$12$Cg2ZP3kJmLQ3u3R9bO2FxeTXdYhmtywIykmP3ye4kv6pZvdfHax7K",
+	},
+	{
+		"lètmein",
+		"bcrypt_sha256$$2b$04$abcdefghijklmnopqrstuulyx/yrfLnuLCi6gwFG5mrkJjuQKpL6S",
+	},
+}
+
+func TestCheckPasswordDjangoHashes(t *testing.T) {
+	for _, h := range djangoHashes {
+		if ok, _ := CheckPassword(h.password, h.encoded); !ok {
+			t.Errorf("%s: password not accepted", h.encoded)
+		}
+		if ok, _ := CheckPassword(h.password+"x", h.encoded); ok {
+			t.Errorf("%s: wrong password accepted", h.encoded)
+		}
+	}
+}
+
+func TestEncodeMatchesDjango(t *testing.T) {
+	cases := []struct {
+		hasher   Hasher
+		salt     string
+		encoded  string
+		password string
+	}{
+		{
+			&PBKDF2PasswordHasher{}, "seasalt",
+			"pbkdf2_sha256$1000000$seasalt$r1uLUxoxpP2Ued/qxvmje7UH9PUJBkRrvf9gGPL7Cps=",
+			"lètmein",
+		},
+		{
+			&PBKDF2PasswordHasher{Iterations: 260000}, "seasalt",
+			"pbkdf2_sha256$260000$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo=",
+			"lètmein",
+		},
+		{
+			&PBKDF2SHA1PasswordHasher{}, "seasalt2",
+			"pbkdf2_sha1$1000000$seasalt2$3R9hvSAiAy5ARspAFy5GJ/2rjXo=",
+			"lètmein",
+		},
+	}
+
+	for _, c := range cases {
+		encoded, err := c.hasher.Encode(c.password, c.salt)
+		if err != nil {
+			t.Fatalf("%s: %v", c.hasher.Algorithm(), err)
+		}
+		if encoded != c.encoded {
+			t.Errorf("%s: got %s, want %s", c.hasher.Algorithm(), encoded, c.encoded)
+		}
+	}
+}
+
+func TestMustUpdate(t *testing.T) {
+	cases := []struct {
+		encoded string
+		update  bool
+	}{
+		{"pbkdf2_sha256$1000000$seasalt$r1uLUxoxpP2Ued/qxvmje7UH9PUJBkRrvf9gGPL7Cps=", false},
+		{"pbkdf2_sha256$260000$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo=", true},
+		{"argon2$argon2i$v=19$m=8,t=1,p=1$c2FsdHNhbHQ$YC9+jJCrQhs5R6db7LlN8Q", true},
+	}
+
+	for _, c := range cases {
+		hasher, err := IdentifyHasher(c.encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", c.encoded, err)
+		}
+		if got := hasher.MustUpdate(c.encoded); got != c.update {
+			t.Errorf("%s: MustUpdate() = %v, want %v", c.encoded, got, c.update)
+		}
+	}
+}
+
+func TestUnusablePassword(t *testing.T) {
+	encoded := MakeUnusablePassword()
+	if IsPasswordUsable(encoded) {
+		t.Errorf("%s is usable", encoded)
+	}
+	if ok, _ := CheckPassword("", encoded); ok {
+		t.Errorf("%s accepted a password", encoded)
+	}
+}
@@ -0,0 +1,179 @@
+package hashers
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBKDF2Iterations is the iteration count django 5.2 uses for new hashes.
+const PBKDF2Iterations = 1000000
+
+// PBKDF2PasswordHasher is django's default "pbkdf2_sha256" hasher.
+type PBKDF2PasswordHasher struct {
+	// Iterations defaults to PBKDF2Iterations.
+	Iterations int
+}
+
+func (h *PBKDF2PasswordHasher) Algorithm() string {
+	return "pbkdf2_sha256"
+}
+
+func (h *PBKDF2PasswordHasher) iterations() int {
+	return pbkdf2Iterations(h.Iterations)
+}
+
+func (h *PBKDF2PasswordHasher) Salt() string {
+	return salt()
+}
+
+func (h *PBKDF2PasswordHasher) Encode(password, salt string) (string, error) {
+	return pbkdf2Encode(h.Algorithm(), sha256.New, password, salt, h.iterations())
+}
+
+func (h *PBKDF2PasswordHasher) Verify(password, encoded string) bool {
+	return pbkdf2Verify(h.Algorithm(), sha256.New, password, encoded)
+}
+
+func (h *PBKDF2PasswordHasher) MustUpdate(encoded string) bool {
+	return pbkdf2MustUpdate(encoded, h.iterations())
+}
+
+func (h *PBKDF2PasswordHasher) HardenRuntime(password, encoded string) {
+	pbkdf2HardenRuntime(sha256.New, password, encoded, h.iterations())
+}
+
+// PBKDF2SHA1PasswordHasher is django's "pbkdf2_sha1" hasher.
+type PBKDF2SHA1PasswordHasher struct {
+	// Iterations defaults to PBKDF2Iterations.
+	Iterations int
+}
+
+func (h *PBKDF2SHA1PasswordHasher) Algorithm() string {
+	return "pbkdf2_sha1"
+}
+
+func (h *PBKDF2SHA1PasswordHasher) iterations() int {
+	return pbkdf2Iterations(h.Iterations)
+}
+
+func (h *PBKDF2SHA1PasswordHasher) Salt() string {
+	return salt()
+}
+
+func (h *PBKDF2SHA1PasswordHasher) Encode(password, salt string) (string, error) {
+	return pbkdf2Encode(h.Algorithm(), sha1.New, password, salt, h.iterations())
+}
+
+func (h *PBKDF2SHA1PasswordHasher) Verify(password, encoded string) bool {
+	return pbkdf2Verify(h.Algorithm(), sha1.New, password, encoded)
+}
+
+func (h *PBKDF2SHA1PasswordHasher) MustUpdate(encoded string) bool {
+	return pbkdf2MustUpdate(encoded, h.iterations())
+}
+
+func (h *PBKDF2SHA1PasswordHasher) HardenRuntime(password, encoded string) {
+	pbkdf2HardenRuntime(sha1.New, password, encoded, h.iterations())
+}
+
+func pbkdf2Iterations(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	return PBKDF2Iterations
+}
+
+type pbkdf2Hash struct {
+	algorithm  string
+	iterations int
+	salt       string
+	hash       string
+}
+
+func pbkdf2Decode(encoded string) (*pbkdf2Hash, error) {
+	parts := strings.SplitN(encoded, "$", 4)
+	if len(parts) != 4 {
+		return nil, errors.Trace(ErrBadEncoding)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.Annotate(ErrBadEncoding, err.Error())
+	}
+
+	return &pbkdf2Hash{
+		algorithm: parts[0], iterations: iterations,
+		salt: parts[2], hash: parts[3],
+	}, nil
+}
+
+func pbkdf2Hash64(
+	digest func() hash.Hash, password, salt string, iterations int,
+) string {
+	key := pbkdf2.Key(
+		[]byte(password), []byte(salt), iterations, digest().Size(), digest,
+	)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func pbkdf2Encode(
+	algorithm string, digest func() hash.Hash,
+	password, salt string, iterations int,
+) (string, error) {
+	if salt == "" || strings.Contains(salt, "$") {
+		return "", errors.New("salt must be non empty and not contain $")
+	}
+
+	return fmt.Sprintf(
+		"%s$%d$%s$%s", algorithm, iterations, salt,
+		pbkdf2Hash64(digest, password, salt, iterations),
+	), nil
+}
+
+func pbkdf2Verify(
+	algorithm string, digest func() hash.Hash, password, encoded string,
+) bool {
+	decoded, err := pbkdf2Decode(encoded)
+	if err != nil || decoded.algorithm != algorithm {
+		return false
+	}
+
+	candidate, err := pbkdf2Encode(
+		algorithm, digest, password, decoded.salt, decoded.iterations,
+	)
+	if err != nil {
+		return false
+	}
+
+	return constantTimeEqual(encoded, candidate)
+}
+
+func pbkdf2MustUpdate(encoded string, iterations int) bool {
+	decoded, err := pbkdf2Decode(encoded)
+	if err != nil {
+		return false
+	}
+	return decoded.iterations != iterations
+}
+
+func pbkdf2HardenRuntime(
+	digest func() hash.Hash, password, encoded string, iterations int,
+) {
+	decoded, err := pbkdf2Decode(encoded)
+	if err != nil {
+		return
+	}
+
+	extra := iterations - decoded.iterations
+	if extra > 0 {
+		pbkdf2Hash64(digest, password, decoded.salt, extra)
+	}
+}
@@ -0,0 +1,266 @@
+// Package otp verifies one time passwords against the devices django-otp
+// keeps in otp_totp_totpdevice and otp_static_staticdevice, and marks sessions
+// verified the way django-otp does so both sides agree on who passed 2FA.
+package otp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// SessionKey is django-otp's DEVICE_ID_SESSION_KEY, the persistent id of the
+// device the user verified with is stored under it.
+const SessionKey = "otp_device_id"
+
+var (
+	ErrInvalidToken = errors.New("invalid otp token")
+	ErrNoDevice     = errors.New("no such otp device")
+)
+
+// Device is a confirmed or unconfirmed django-otp device of a user.
+type Device interface {
+	ID() int64
+	UserID() int64
+	Name() string
+	Confirmed() bool
+	// PersistentID() is what django-otp stores in the session, like
+	// "otp_totp.totpdevice/1".
+	PersistentID() string
+}
+
+// Tables name the django-otp tables, they default to the ones django-otp
+// creates.
+type Tables struct {
+	TOTPDeviceTable   string
+	StaticDeviceTable string
+	StaticTokenTable  string
+	// ThrottleFactor is OTP_TOTP_THROTTLE_FACTOR and
+	// OTP_STATIC_THROTTLE_FACTOR, after n failures a device accepts no token
+	// for ThrottleFactor * 2^(n-1) seconds. Defaults to one second, set it
+	// negative to turn throttling off.
+	ThrottleFactor time.Duration
+	// NoSync keeps the drift of TOTP devices unchanged, like setting
+	// OTP_TOTP_SYNC to False.
+	NoSync bool
+}
+
+func updateTablesWithDefault(t *Tables) {
+	if t.TOTPDeviceTable == "" {
+		t.TOTPDeviceTable = "otp_totp_totpdevice"
+	}
+	if t.StaticDeviceTable == "" {
+		t.StaticDeviceTable = "otp_static_staticdevice"
+	}
+	if t.StaticTokenTable == "" {
+		t.StaticTokenTable = "otp_static_statictoken"
+	}
+	if t.ThrottleFactor == 0 {
+		t.ThrottleFactor = time.Second
+	}
+}
+
+// Store finds the devices of users and verifies tokens against them.
+type Store interface {
+	// Devices() returns the confirmed devices of user.
+	Devices(ctx context.Context, user django.User) ([]Device, error)
+	// DeviceByPersistentID() returns ErrNoDevice if there is no such device.
+	DeviceByPersistentID(ctx context.Context, id string) (Device, error)
+	// VerifyToken() checks token against every confirmed device of user, like
+	// django_otp.match_token(), and returns the device it matched.
+	// ErrInvalidToken is returned if none matched.
+	VerifyToken(ctx context.Context, user django.User, token string) (Device, error)
+	// Login() marks session as verified with device, like django_otp.login().
+	Login(ctx context.Context, session django.Session, device Device) error
+	// IsVerified() returns true if session was verified with a confirmed
+	// device of user, like django-otp's user.is_verified().
+	IsVerified(
+		ctx context.Context, session django.Session, user django.User,
+	) (bool, error)
+}
+
+// NewCustomStore creates a Store reading the django-otp tables in tables.
+func NewCustomStore(tables Tables) Store {
+	updateTablesWithDefault(&tables)
+	return &store{tables}
+}
+
+// NewStore creates a Store with default Tables.
+func NewStore() Store {
+	return NewCustomStore(Tables{})
+}
+
+type store struct {
+	Tables
+}
+
+func (s *store) Devices(
+	ctx context.Context, user django.User,
+) ([]Device, error) {
+	totps, err := s.totpDevices(ctx, "user_id = $1 AND confirmed", user.ID())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	statics, err := s.staticDevices(ctx, "user_id = $1 AND confirmed", user.ID())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	devices := []Device{}
+	for _, d := range totps {
+		devices = append(devices, d)
+	}
+	for _, d := range statics {
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func (s *store) DeviceByPersistentID(
+	ctx context.Context, id string,
+) (Device, error) {
+	idx := strings.LastIndex(id, "/")
+	if idx == -1 {
+		return nil, errors.Annotate(ErrNoDevice, id)
+	}
+	pk, err := strconv.ParseInt(id[idx+1:], 10, 64)
+	if err != nil {
+		return nil, errors.Annotate(ErrNoDevice, id)
+	}
+
+	var devices []Device
+	switch id[:idx] {
+	case totpModelLabel:
+		totps, err := s.totpDevices(ctx, "id = $1", pk)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, d := range totps {
+			devices = append(devices, d)
+		}
+	case staticModelLabel:
+		statics, err := s.staticDevices(ctx, "id = $1", pk)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, d := range statics {
+			devices = append(devices, d)
+		}
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.Annotate(ErrNoDevice, id)
+	}
+	return devices[0], nil
+}
+
+func (s *store) VerifyToken(
+	ctx context.Context, user django.User, token string,
+) (Device, error) {
+	totps, err := s.totpDevices(ctx, "user_id = $1 AND confirmed", user.ID())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, d := range totps {
+		ok, err := s.verifyTOTP(ctx, d, token)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if ok {
+			return d, nil
+		}
+	}
+
+	statics, err := s.staticDevices(ctx, "user_id = $1 AND confirmed", user.ID())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, d := range statics {
+		ok, err := s.verifyStatic(ctx, d, token)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if ok {
+			return d, nil
+		}
+	}
+
+	amalgam.LOGGER.Info("otp_token_rejected", "user", user.ID())
+	return nil, errors.Trace(ErrInvalidToken)
+}
+
+func (s *store) Login(
+	ctx context.Context, session django.Session, device Device,
+) error {
+	return errors.Trace(session.SetValue(ctx, SessionKey, device.PersistentID()))
+}
+
+func (s *store) IsVerified(
+	ctx context.Context, session django.Session, user django.User,
+) (bool, error) {
+	id, err := session.GetString(SessionKey)
+	if err != nil || id == "" {
+		return false, nil
+	}
+
+	device, err := s.DeviceByPersistentID(ctx, id)
+	if err != nil {
+		if errors.Cause(err) == ErrNoDevice {
+			return false, nil
+		}
+		return false, errors.Trace(err)
+	}
+
+	return device.Confirmed() && device.UserID() == user.ID(), nil
+}
+
+// throttle holds django-otp's ThrottlingMixin columns.
+type throttle struct {
+	FailureCount     int        `db:"throttling_failure_count"`
+	FailureTimestamp *time.Time `db:"throttling_failure_timestamp"`
+}
+
+// allowed is ThrottlingMixin.verify_is_allowed(). python's delay grows without
+// bound, here it stops at the longest time.Duration instead of overflowing.
+func (t *throttle) allowed(factor time.Duration) bool {
+	if factor < 0 || t.FailureCount == 0 || t.FailureTimestamp == nil {
+		return true
+	}
+
+	delay := time.Duration(math.MaxInt64)
+	if n := uint(t.FailureCount - 1); n < 63 && factor <= delay>>n {
+		delay = factor << n
+	}
+	return !time.Now().Before(t.FailureTimestamp.Add(delay))
+}
+
+// recordFailure is ThrottlingMixin.throttle_increment(). Like django-otp it is
+// saved right away, outside the request transaction, so failures count even
+// if the request is rolled back.
+func (s *store) recordFailure(ctx context.Context, table string, id int64) error {
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE %s SET throttling_failure_count = throttling_failure_count + 1,
+		throttling_failure_timestamp = $1 WHERE id = $2`, table,
+	)
+	_, err = db.Exec(query, time.Now(), id)
+	return errors.Trace(err)
+}
+
+// parseToken is how django-otp reads tokens, surrounding space is ignored and
+// leading zeros do not matter.
+func parseToken(token string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(token), 10, 64)
+	return n, err == nil && n >= 0
+}
@@ -0,0 +1,139 @@
+package otp
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// rfcKey is the secret of the test vectors in RFC 4226 and RFC 6238.
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTPMatchesRFC4226(t *testing.T) {
+	// RFC 4226 appendix D.
+	want := []int64{
+		755224, 287082, 359152, 969429, 338314,
+		254676, 287922, 162583, 399871, 520489,
+	}
+	for counter, code := range want {
+		if got := hotp(rfcKey, int64(counter), 6); got != code {
+			t.Errorf("hotp(%d) = %06d, want %06d", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	// the SHA1 rows of RFC 6238 appendix B.
+	cases := []struct {
+		unix int64
+		code int64
+	}{
+		{59, 94287082},
+		{1111111109, 7081804},
+		{1111111111, 14050471},
+		{1234567890, 89005924},
+		{2000000000, 69279037},
+		{20000000000, 65353130},
+	}
+
+	key := hex.EncodeToString(rfcKey)
+	for _, c := range cases {
+		d := &totpDevice{Key: key, Step: 30, Digits: 8, LastT: -1}
+		raw, _ := hex.DecodeString(d.Key)
+		step, _, ok := d.match(raw, c.code, time.Unix(c.unix, 0))
+		if !ok || step != c.unix/30 {
+			t.Errorf("%d: match() = %d, %v", c.unix, step, ok)
+		}
+	}
+}
+
+func TestTOTPTolerance(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / 30
+	d := &totpDevice{Step: 30, Digits: 6, Tolerance: 1, LastT: -1}
+
+	for _, offset := range []int64{-1, 0, 1} {
+		_, drift, ok := d.match(rfcKey, hotp(rfcKey, step+offset, 6), now)
+		if !ok || drift != offset {
+			t.Errorf("offset %d: match() = %d, %v", offset, drift, ok)
+		}
+	}
+	if _, _, ok := d.match(rfcKey, hotp(rfcKey, step+2, 6), now); ok {
+		t.Error("token outside the tolerance accepted")
+	}
+}
+
+func TestTOTPRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / 30
+	code := hotp(rfcKey, step, 6)
+	d := &totpDevice{Step: 30, Digits: 6, Tolerance: 1, LastT: -1}
+
+	used, _, ok := d.match(rfcKey, code, now)
+	if !ok {
+		t.Fatal("token not accepted")
+	}
+
+	// totpVerified stores the step, after that the token and older ones fail.
+	d.LastT = used
+	if _, _, ok := d.match(rfcKey, code, now); ok {
+		t.Error("token accepted twice")
+	}
+	if _, _, ok := d.match(rfcKey, hotp(rfcKey, step-1, 6), now); ok {
+		t.Error("token older than last_t accepted")
+	}
+	if _, _, ok := d.match(rfcKey, hotp(rfcKey, step+1, 6), now); !ok {
+		t.Error("token after last_t rejected")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		ts := time.Now().Add(-d)
+		return &ts
+	}
+
+	cases := []struct {
+		name    string
+		t       throttle
+		factor  time.Duration
+		allowed bool
+	}{
+		{"no failures", throttle{}, time.Second, true},
+		{"one failure now", throttle{1, ago(0)}, time.Second, false},
+		{"one failure, waited", throttle{1, ago(2 * time.Second)}, time.Second, true},
+		{"three failures, too soon", throttle{3, ago(3 * time.Second)}, time.Second, false},
+		{"three failures, waited", throttle{3, ago(5 * time.Second)}, time.Second, true},
+		// 2^39 seconds would overflow time.Duration.
+		{"40 failures", throttle{40, ago(24 * time.Hour)}, time.Second, false},
+		{"1000 failures", throttle{1000, ago(24 * time.Hour)}, time.Second, false},
+		{"throttling off", throttle{1000, ago(0)}, -1, true},
+	}
+
+	for _, c := range cases {
+		if allowed := c.t.allowed(c.factor); allowed != c.allowed {
+			t.Errorf("%s: allowed() = %v, want %v", c.name, allowed, c.allowed)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	cases := []struct {
+		token string
+		code  int64
+		ok    bool
+	}{
+		{"123456", 123456, true},
+		{" 012345 ", 12345, true},
+		{"12a456", 0, false},
+		{"-12345", 0, false},
+		{"", 0, false},
+	}
+
+	for _, c := range cases {
+		code, ok := parseToken(c.token)
+		if ok != c.ok || (ok && code != c.code) {
+			t.Errorf("parseToken(%q) = %d, %v", c.token, code, ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package otp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amitu/amalgam"
+	"github.com/juju/errors"
+)
+
+const staticModelLabel = "otp_static.staticdevice"
+
+type staticDevice struct {
+	DID        int64  `db:"id"`
+	DUserID    int64  `db:"user_id"`
+	DName      string `db:"name"`
+	DConfirmed bool   `db:"confirmed"`
+	throttle
+}
+
+func (d *staticDevice) ID() int64 {
+	return d.DID
+}
+
+func (d *staticDevice) UserID() int64 {
+	return d.DUserID
+}
+
+func (d *staticDevice) Name() string {
+	return d.DName
+}
+
+func (d *staticDevice) Confirmed() bool {
+	return d.DConfirmed
+}
+
+func (d *staticDevice) PersistentID() string {
+	return fmt.Sprintf("%s/%d", staticModelLabel, d.DID)
+}
+
+func (s *store) staticDevices(
+	ctx context.Context, where string, args ...interface{},
+) ([]*staticDevice, error) {
+	devices := []*staticDevice{}
+	query := `
+		SELECT
+			id, user_id, name, confirmed, throttling_failure_count,
+			throttling_failure_timestamp
+		FROM ` + s.StaticDeviceTable + `
+		WHERE ` + where + `
+		ORDER BY id
+	`
+	err := amalgam.QueryIntoSlice(ctx, &devices, query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return devices, nil
+}
+
+// verifyStatic is StaticDevice.verify_token(), a matching backup token is
+// deleted so it can not be used again. The delete does not wait for the
+// request transaction.
+func (s *store) verifyStatic(
+	ctx context.Context, d *staticDevice, token string,
+) (bool, error) {
+	if !d.allowed(s.ThrottleFactor) {
+		amalgam.LOGGER.Info("otp_device_throttled", "device", d.PersistentID())
+		return false, nil
+	}
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	result, err := db.Exec(
+		`DELETE FROM `+s.StaticTokenTable+` WHERE id IN (
+			SELECT id FROM `+s.StaticTokenTable+`
+			WHERE device_id = $1 AND token = $2 LIMIT 1
+		)`,
+		d.DID, token,
+	)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if rows == 0 {
+		err := s.recordFailure(ctx, s.StaticDeviceTable, d.DID)
+		return false, errors.Trace(err)
+	}
+
+	_, err = db.Exec(
+		`UPDATE `+s.StaticDeviceTable+` SET throttling_failure_count = 0,
+		throttling_failure_timestamp = NULL WHERE id = $1`,
+		d.DID,
+	)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,185 @@
+package otp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/juju/errors"
+)
+
+const totpModelLabel = "otp_totp.totpdevice"
+
+type totpDevice struct {
+	DID        int64  `db:"id"`
+	DUserID    int64  `db:"user_id"`
+	DName      string `db:"name"`
+	DConfirmed bool   `db:"confirmed"`
+	// Key is hex encoded.
+	Key       string `db:"key"`
+	Step      int64  `db:"step"`
+	T0        int64  `db:"t0"`
+	Digits    int    `db:"digits"`
+	Tolerance int64  `db:"tolerance"`
+	Drift     int64  `db:"drift"`
+	LastT     int64  `db:"last_t"`
+	throttle
+}
+
+func (d *totpDevice) ID() int64 {
+	return d.DID
+}
+
+func (d *totpDevice) UserID() int64 {
+	return d.DUserID
+}
+
+func (d *totpDevice) Name() string {
+	return d.DName
+}
+
+func (d *totpDevice) Confirmed() bool {
+	return d.DConfirmed
+}
+
+func (d *totpDevice) PersistentID() string {
+	return fmt.Sprintf("%s/%d", totpModelLabel, d.DID)
+}
+
+func (s *store) totpDevices(
+	ctx context.Context, where string, args ...interface{},
+) ([]*totpDevice, error) {
+	devices := []*totpDevice{}
+	query := `
+		SELECT
+			id, user_id, name, confirmed, key, step, t0, digits, tolerance,
+			drift, last_t, throttling_failure_count,
+			throttling_failure_timestamp
+		FROM ` + s.TOTPDeviceTable + `
+		WHERE ` + where + `
+		ORDER BY id
+	`
+	err := amalgam.QueryIntoSlice(ctx, &devices, query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return devices, nil
+}
+
+// hotp is RFC 4226 with sha1, like django_otp.oath.hotp().
+func hotp(key []byte, counter int64, digits int) int64 {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := int64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+
+	mod := int64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return code % mod
+}
+
+// match returns the step code is the token of and the drift it was found at.
+// Tokens from up to Tolerance steps before or after now are accepted, but
+// never one from a step at or before LastT, so a token can only be used once.
+func (d *totpDevice) match(
+	key []byte, code int64, now time.Time,
+) (int64, int64, bool) {
+	step := (now.Unix() - d.T0) / d.Step
+	for offset := -d.Tolerance; offset <= d.Tolerance; offset++ {
+		drift := d.Drift + offset
+		t := step + drift
+		if t >= d.LastT+1 && hotp(key, t, d.Digits) == code {
+			return t, drift, true
+		}
+	}
+	return 0, 0, false
+}
+
+// verifyTOTP is TOTPDevice.verify_token().
+func (s *store) verifyTOTP(
+	ctx context.Context, d *totpDevice, token string,
+) (bool, error) {
+	if !d.allowed(s.ThrottleFactor) {
+		amalgam.LOGGER.Info("otp_device_throttled", "device", d.PersistentID())
+		return false, nil
+	}
+
+	if d.Step <= 0 {
+		amalgam.LOGGER.Warn(
+			"otp_device_invalid", "device", d.PersistentID(), "step", d.Step,
+		)
+		return false, nil
+	}
+
+	// like django-otp a malformed token counts as a failure.
+	code, ok := parseToken(token)
+	if !ok {
+		err := s.recordFailure(ctx, s.TOTPDeviceTable, d.DID)
+		return false, errors.Trace(err)
+	}
+
+	key, err := hex.DecodeString(d.Key)
+	if err != nil {
+		return false, errors.Annotatef(err, "bad key for %s", d.PersistentID())
+	}
+
+	if t, drift, ok := d.match(key, code, time.Now()); ok {
+		if s.NoSync {
+			drift = d.Drift
+		}
+		return s.totpVerified(ctx, d, t, drift)
+	}
+
+	if err := s.recordFailure(ctx, s.TOTPDeviceTable, d.DID); err != nil {
+		return false, errors.Trace(err)
+	}
+	return false, nil
+}
+
+// totpVerified saves the step the device was used at. Like recordFailure it
+// does not wait for the request transaction, and it only succeeds if no
+// concurrent request used the same or a later step.
+func (s *store) totpVerified(
+	ctx context.Context, d *totpDevice, t, drift int64,
+) (bool, error) {
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	result, err := db.Exec(
+		`UPDATE `+s.TOTPDeviceTable+` SET last_t = $1, drift = $2,
+		throttling_failure_count = 0, throttling_failure_timestamp = NULL
+		WHERE id = $3 AND last_t < $1`,
+		t, drift, d.DID,
+	)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if rows == 0 {
+		amalgam.LOGGER.Warn("otp_token_replayed", "device", d.PersistentID())
+		return false, nil
+	}
+
+	d.LastT, d.Drift = t, drift
+	d.FailureCount, d.FailureTimestamp = 0, nil
+	return true, nil
+}
@@ -0,0 +1,284 @@
+// Package phonelogin logs users in with one time codes sent to their phone by
+// SMS. Codes are kept hashed in a table with one row per phone, see Schema.
+package phonelogin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/signing"
+	"github.com/juju/errors"
+)
+
+// Schema creates the default code table, if it is managed by a django model
+// instead that model must have the same columns.
+const Schema = `
+CREATE TABLE IF NOT EXISTS amalgam_phone_login (
+	phone      varchar(32) PRIMARY KEY,
+	code_hash  varchar(64) NOT NULL,
+	sent_at    timestamp with time zone NOT NULL,
+	expires_at timestamp with time zone NOT NULL,
+	attempts   integer NOT NULL DEFAULT 0
+)
+`
+
+var (
+	// ErrCooldown is returned by RequestCode() if a code was sent to the phone
+	// less than Options.ResendCooldown ago.
+	ErrCooldown = errors.New("code sent too recently")
+	// ErrBadCode is returned by VerifyCode() if the code is wrong, expired,
+	// was never sent, or too many wrong codes were tried.
+	ErrBadCode = errors.New("bad code")
+)
+
+// Sender delivers SMS.
+type Sender interface {
+	SendSMS(ctx context.Context, phone, text string) error
+}
+
+// LogSender logs messages instead of sending them, for local development.
+type LogSender struct{}
+
+func (LogSender) SendSMS(_ context.Context, phone, text string) error {
+	amalgam.LOGGER.Info("phone_login_sms", "phone", phone, "text", text)
+	return nil
+}
+
+// Options configure a Store created by NewCustomStore.
+type Options struct {
+	// Users finds users by phone, it is required.
+	Users django.UserStore
+	// Sender defaults to LogSender.
+	Sender Sender
+	// Table defaults to "amalgam_phone_login".
+	Table string
+	// Secret the codes are hashed with, defaults to amalgam.Secret.
+	Secret string
+	// Digits in a code, defaults to 6.
+	Digits int
+	// Message is a fmt format for the SMS with the code as its only argument.
+	Message string
+	// TTL is how long a code can be used, defaults to five minutes.
+	TTL time.Duration
+	// MaxAttempts is how many codes can be tried for each code sent, defaults
+	// to 5.
+	MaxAttempts int
+	// ResendCooldown is the least time between two codes to the same phone,
+	// defaults to 30 seconds.
+	ResendCooldown time.Duration
+	// CreateUsers makes VerifyCode() create a user with
+	// UserStore.GetOrCreateUser() if there is none with the phone. The user
+	// is made active if the store implements django.UserFields and the model
+	// has is_active.
+	CreateUsers bool
+}
+
+func updateOptionsWithDefault(o *Options) {
+	if o.Sender == nil {
+		o.Sender = LogSender{}
+	}
+	if o.Table == "" {
+		o.Table = "amalgam_phone_login"
+	}
+	if o.Secret == "" {
+		o.Secret = amalgam.Secret
+	}
+	if o.Digits == 0 {
+		o.Digits = 6
+	}
+	if o.Message == "" {
+		o.Message = "%s is your login code"
+	}
+	if o.TTL == 0 {
+		o.TTL = time.Minute * 5
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 5
+	}
+	if o.ResendCooldown == 0 {
+		o.ResendCooldown = time.Second * 30
+	}
+}
+
+// Store sends and verifies login codes. All its writes are made outside the
+// request transaction, so sent codes and failed attempts are not forgotten if
+// the request is rolled back.
+type Store interface {
+	// RequestCode() sends a new code to phone, replacing any earlier code.
+	RequestCode(ctx context.Context, phone string) error
+	// VerifyCode() returns the user with phone if code is the last code sent
+	// to it. The code can not be used again. django.ErrInvalidCredentials is
+	// returned if there is no such active user.
+	VerifyCode(ctx context.Context, phone, code string) (django.User, error)
+}
+
+// NewCustomStore creates a Store.
+func NewCustomStore(options Options) (Store, error) {
+	if options.Users == nil {
+		return nil, errors.New("phonelogin: Options.Users is required")
+	}
+
+	updateOptionsWithDefault(&options)
+	return &store{options}, nil
+}
+
+// NewStore creates a Store with default Options.
+func NewStore(users django.UserStore, sender Sender) (Store, error) {
+	return NewCustomStore(Options{Users: users, Sender: sender})
+}
+
+type store struct {
+	options Options
+}
+
+func (s *store) hashCode(phone, code string) string {
+	return hex.EncodeToString(signing.SaltedHMAC(
+		sha256.New, "amalgam.phonelogin", s.options.Secret,
+		[]byte(phone+":"+code),
+	))
+}
+
+func (s *store) RequestCode(ctx context.Context, phone string) error {
+	phone = strings.TrimSpace(phone)
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	code := amalgam.GetSecureRandomDigits(s.options.Digits)
+	now := time.Now()
+
+	// the WHERE makes the cooldown hold for concurrent requests as well.
+	result, err := db.Exec(
+		`
+			INSERT INTO `+s.options.Table+` AS t
+				(phone, code_hash, sent_at, expires_at, attempts)
+			VALUES ($1, $2, $3, $4, 0)
+			ON CONFLICT (phone) DO UPDATE SET
+				code_hash = EXCLUDED.code_hash, sent_at = EXCLUDED.sent_at,
+				expires_at = EXCLUDED.expires_at, attempts = 0
+			WHERE t.sent_at <= $5
+		`,
+		phone, s.hashCode(phone, code), now, now.Add(s.options.TTL),
+		now.Add(-s.options.ResendCooldown),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rows == 0 {
+		return errors.Trace(ErrCooldown)
+	}
+
+	text := fmt.Sprintf(s.options.Message, code)
+	if err := s.options.Sender.SendSMS(ctx, phone, text); err != nil {
+		// the code never arrived, so it must neither start the cooldown nor
+		// be usable. A code sent meanwhile by another request is kept.
+		_, derr := db.Exec(
+			"DELETE FROM "+s.options.Table+" WHERE phone = $1 AND code_hash = $2",
+			phone, s.hashCode(phone, code),
+		)
+		if derr != nil {
+			amalgam.LOGGER.Error(
+				"phone_login_code_not_deleted", "phone", phone, "err", derr,
+			)
+		}
+		return errors.Trace(err)
+	}
+
+	amalgam.Counter("phone_login_code_sent", 1, 1)
+	return nil
+}
+
+func (s *store) VerifyCode(
+	ctx context.Context, phone, code string,
+) (django.User, error) {
+	phone = strings.TrimSpace(phone)
+	code = strings.TrimSpace(code)
+
+	db, err := amalgam.Ctx2Db(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// every try uses up an attempt, whether the code is right or not.
+	var codeHash string
+	err = db.QueryRow(
+		`
+			UPDATE `+s.options.Table+` SET attempts = attempts + 1
+			WHERE phone = $1 AND expires_at > $2 AND attempts < $3
+			RETURNING code_hash
+		`,
+		phone, time.Now(), s.options.MaxAttempts,
+	).Scan(&codeHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Annotate(ErrBadCode, "no usable code")
+		}
+		return nil, errors.Trace(err)
+	}
+
+	if !hmac.Equal([]byte(codeHash), []byte(s.hashCode(phone, code))) {
+		amalgam.LOGGER.Info("phone_login_bad_code", "phone", phone)
+		amalgam.Counter("phone_login_bad_code", 1, 1)
+		return nil, errors.Trace(ErrBadCode)
+	}
+
+	_, err = db.Exec(
+		"DELETE FROM "+s.options.Table+" WHERE phone = $1 AND code_hash = $2",
+		phone, codeHash,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.user(ctx, phone)
+}
+
+func (s *store) user(ctx context.Context, phone string) (django.User, error) {
+	user, err := s.options.Users.UserByPhone(ctx, phone)
+	if err != nil {
+		if errors.Cause(err) != sql.ErrNoRows {
+			return nil, errors.Trace(err)
+		}
+		if !s.options.CreateUsers {
+			return nil, errors.Annotate(
+				django.ErrInvalidCredentials, "no user with phone",
+			)
+		}
+
+		// the phone was just verified, so the new user can log in. Models
+		// without is_active get their defaults.
+		details := map[string]interface{}{"phone": phone}
+		fields, ok := s.options.Users.(django.UserFields)
+		if ok && fields.HasUserField("is_active") {
+			details["is_active"] = true
+		}
+		user, err = s.options.Users.GetOrCreateUser(ctx, details)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	v, _ := user.Field("is_active")
+	if active, ok := v.(bool); ok && !active {
+		return nil, errors.Annotate(
+			django.ErrInvalidCredentials, "user is inactive",
+		)
+	}
+
+	return user, nil
+}
@@ -1,10 +1,31 @@
 package django
 
-import "context"
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/amitu/amalgam/django/signing"
+	"github.com/juju/errors"
+)
 
 const (
-	KeyUserID    = "_auth_user_id"
-	KeyCSRFToken = "_csrf_token"
+	KeyUserID      = "_auth_user_id"
+	KeyUserBackend = "_auth_user_backend"
+	KeyUserHash    = "_auth_user_hash"
+	KeyCSRFToken   = "_csrf_token"
+
+	// ModelBackend is the value django stores under KeyUserBackend for users
+	// authenticated against the user table.
+	ModelBackend = "django.contrib.auth.backends.ModelBackend"
+)
+
+var (
+	// ErrNoUser is returned by Session.GetUser() when nobody is logged in, or
+	// the login is no longer valid because the user's password changed.
+	ErrNoUser = errors.New("no user logged in")
 )
 
 type Session interface {
@@ -33,6 +54,13 @@ type Session interface {
 	// Destroy() destroys the session from session store. Any calls to any method
 	// session object after that may lead to error or crash.
 	Destroy(context.Context) error
+	// CycleKey() moves the session data to a new session key and deletes the
+	// old one, like django's cycle_key(). Used on login to prevent session
+	// fixation.
+	CycleKey(context.Context) error
+	// Flush() deletes the session data and the session from the store, the
+	// session key becomes empty until a new value is set.
+	Flush(context.Context) error
 
 	Store() SessionStore
 
@@ -43,6 +71,99 @@ type SessionStore interface {
 	// If GetSession on store is called with id of a destroyed session, a fresh
 	// session is created and returned.
 	GetSessionBySessionKey(ctx context.Context, key string) (Session, error)
+	// CreateSession returns a new empty session. Stores may defer saving it
+	// until a value is set, its SessionKey() is empty until then.
 	CreateSession(context.Context) (Session, error)
 	DestroySession(ctx context.Context, id string) error
+	// ClearExpired() deletes expired sessions from the store and returns how
+	// many were deleted, it is the equivalent of django's clearsessions
+	// management command. Stores that expire sessions on their own return 0.
+	ClearExpired(context.Context) (int64, error)
+	// SessionAuthHash() returns the auth hash to store in a session on login,
+	// made with the secret GetUser() verifies it with.
+	SessionAuthHash(User) string
+}
+
+// SessionAuthHash is django's AbstractBaseUser.get_session_auth_hash(), it is
+// stored in the session on login so that changing the password logs out all
+// other sessions of the user.
+func SessionAuthHash(user User, secret string) string {
+	var password string
+	switch p := fieldOf(user, "password").(type) {
+	case string:
+		password = p
+	case []byte:
+		password = string(p)
+	}
+
+	keySalt := "django.contrib.auth.models.AbstractBaseUser.get_session_auth_hash"
+	return hex.EncodeToString(
+		signing.SaltedHMAC(sha256.New, keySalt, secret, []byte(password)),
+	)
+}
+
+func fieldOf(user User, name string) interface{} {
+	v, _ := user.Field(name)
+	return v
+}
+
+// UserFromSession returns the user whose id is stored in the session under
+// KeyUserID, like django.contrib.auth.get_user(). django stores the id as a
+// string, older code stored it as a number, both are accepted.
+//
+// The auth hash stored on login is verified against secret. If it only matches
+// one of fallbacks the session key is cycled and the hash updated, if it does
+// not match at all the session is flushed and ErrNoUser returned. Inactive
+// users also give ErrNoUser.
+func UserFromSession(
+	ctx context.Context, s Session, users UserStore,
+	secret string, fallbacks []string,
+) (User, error) {
+	uid, err := s.GetInt64(KeyUserID)
+	if err != nil {
+		suid, err := s.GetString(KeyUserID)
+		if err != nil {
+			return nil, errors.Annotate(ErrNoUser, err.Error())
+		}
+		uid, err = strconv.ParseInt(suid, 0, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	user, err := users.UserByID(ctx, uid)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if active, ok := fieldOf(user, "is_active").(bool); ok && !active {
+		return nil, errors.Annotate(ErrNoUser, "user is inactive")
+	}
+
+	sessionHash, _ := s.GetString(KeyUserHash)
+	authHash := SessionAuthHash(user, secret)
+	if sessionHash != "" && hmac.Equal([]byte(sessionHash), []byte(authHash)) {
+		return user, nil
+	}
+
+	for _, fallback := range fallbacks {
+		fallbackHash := SessionAuthHash(user, fallback)
+		if sessionHash == "" ||
+			!hmac.Equal([]byte(sessionHash), []byte(fallbackHash)) {
+			continue
+		}
+
+		if err := s.CycleKey(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := s.SetValue(ctx, KeyUserHash, authHash); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return user, nil
+	}
+
+	if err := s.Flush(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return nil, errors.Annotate(ErrNoUser, "session auth hash mismatch")
 }
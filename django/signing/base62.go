@@ -0,0 +1,57 @@
+package signing
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const b62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// B62Encode is django.core.signing.b62_encode(), used for timestamps.
+func B62Encode(i int64) string {
+	if i == 0 {
+		return "0"
+	}
+
+	sign := ""
+	if i < 0 {
+		sign = "-"
+		i = -i
+	}
+
+	encoded := ""
+	for i > 0 {
+		encoded = string(b62Alphabet[i%62]) + encoded
+		i = i / 62
+	}
+
+	return sign + encoded
+}
+
+// B62Decode is django.core.signing.b62_decode().
+func B62Decode(s string) (int64, error) {
+	if s == "0" {
+		return 0, nil
+	}
+
+	sign := int64(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+	if s == "" {
+		return 0, errors.New("empty base62 value")
+	}
+
+	var decoded int64
+	for _, c := range s {
+		idx := strings.IndexRune(b62Alphabet, c)
+		if idx == -1 {
+			return 0, errors.Errorf("invalid base62 digit %q", c)
+		}
+		decoded = decoded*62 + int64(idx)
+	}
+
+	return sign * decoded, nil
+}
@@ -0,0 +1,403 @@
+// Package signing is a go port of django.core.signing. Values signed here can
+// be verified by django and the other way round, as long as both sides use the
+// same key, salt and separator.
+package signing
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amitu/amalgam"
+	"github.com/juju/errors"
+)
+
+var (
+	ErrBadSignature = errors.New("bad signature")
+	// ErrSignatureExpired is returned when the signature is valid but older
+	// than the max age passed to Unsign() or Loads(). Like django's
+	// SignatureExpired it still means the value must not be trusted.
+	ErrSignatureExpired = errors.New("signature expired")
+	ErrUnsafeSeparator  = errors.New("unsafe signer separator")
+	ErrUnknownAlgorithm = errors.New("unknown hash algorithm")
+)
+
+const (
+	// DefaultSalt is the salt used by Dumps() and Loads().
+	DefaultSalt = "django.core.signing"
+	// DefaultSep is the separator django uses between value and signature.
+	DefaultSep = ":"
+)
+
+// Signer is django.core.signing.Signer. The zero value signs with
+// amalgam.Secret, ":" as separator, sha256 and salt
+// "django.core.signing.Signer".
+type Signer struct {
+	// Key defaults to amalgam.Secret.
+	Key string
+	// FallbackKeys are also accepted when unsigning, like django's
+	// SECRET_KEY_FALLBACKS.
+	FallbackKeys []string
+	// Sep defaults to ":", like django it may not consist only of letters,
+	// digits, "-", "_" and "=".
+	Sep string
+	// Salt namespaces signatures, so a value signed for one purpose can not
+	// be replayed for another.
+	Salt string
+	// Algorithm is one of "sha256" (the default), "sha1" and "sha512".
+	Algorithm string
+}
+
+func (s *Signer) key() string {
+	if s.Key == "" {
+		return amalgam.Secret
+	}
+	return s.Key
+}
+
+func (s *Signer) sep() (string, error) {
+	if s.Sep == "" {
+		return DefaultSep, nil
+	}
+	// django rejects separators matching ^[A-z0-9-_=]*$, note that A-z also
+	// covers [\]^_ and `.
+	for _, c := range s.Sep {
+		if !(('A' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '=') {
+			return s.Sep, nil
+		}
+	}
+	return "", errors.Annotate(ErrUnsafeSeparator, s.Sep)
+}
+
+func (s *Signer) salt() string {
+	if s.Salt == "" {
+		return "django.core.signing.Signer"
+	}
+	return s.Salt
+}
+
+func (s *Signer) digest() (func() hash.Hash, error) {
+	switch s.Algorithm {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, errors.Annotate(ErrUnknownAlgorithm, s.Algorithm)
+}
+
+// Signature returns the signature Sign() would append to value.
+func (s *Signer) Signature(value string) (string, error) {
+	return s.signature(s.key(), value)
+}
+
+func (s *Signer) signature(key, value string) (string, error) {
+	digest, err := s.digest()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	mac := SaltedHMAC(digest, s.salt()+"signer", key, []byte(value))
+	return b64Encode(mac), nil
+}
+
+// Sign returns value followed by the separator and its signature.
+func (s *Signer) Sign(value string) (string, error) {
+	sep, err := s.sep()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	sig, err := s.Signature(value)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return value + sep + sig, nil
+}
+
+// Unsign verifies signed against Key and FallbackKeys and returns the value
+// that was signed.
+func (s *Signer) Unsign(signed string) (string, error) {
+	sep, err := s.sep()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	idx := strings.LastIndex(signed, sep)
+	if idx == -1 {
+		return "", errors.Annotatef(ErrBadSignature, "no %q found in value", sep)
+	}
+	value, sig := signed[:idx], signed[idx+len(sep):]
+
+	for _, key := range append([]string{s.key()}, s.FallbackKeys...) {
+		expected, err := s.signature(key, value)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return value, nil
+		}
+	}
+
+	return "", errors.Annotatef(ErrBadSignature, "signature %q does not match", sig)
+}
+
+// SignObject serializes obj as json, optionally compresses it, and signs the
+// base64 encoded result.
+func (s *Signer) SignObject(obj interface{}, compress bool) (string, error) {
+	payload, err := encodePayload(obj, compress)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return s.Sign(payload)
+}
+
+// UnsignObject verifies signed and decodes the signed json into v.
+func (s *Signer) UnsignObject(signed string, v interface{}) error {
+	payload, err := s.Unsign(signed)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(decodePayload(payload, v))
+}
+
+// TimestampSigner is django.core.signing.TimestampSigner, it adds a base62
+// timestamp to the value before signing it so that Unsign() can enforce a max
+// age. Its default salt is "django.core.signing.TimestampSigner".
+type TimestampSigner struct {
+	Signer
+}
+
+func (t *TimestampSigner) signer() *Signer {
+	s := t.Signer
+	if s.Salt == "" {
+		s.Salt = "django.core.signing.TimestampSigner"
+	}
+	return &s
+}
+
+// Timestamp returns the current time as django encodes it.
+func (t *TimestampSigner) Timestamp() string {
+	return B62Encode(time.Now().Unix())
+}
+
+func (t *TimestampSigner) Sign(value string) (string, error) {
+	s := t.signer()
+	sep, err := s.sep()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return s.Sign(value + sep + t.Timestamp())
+}
+
+// Unsign verifies signed and returns the value that was signed. If maxAge is
+// not zero and the signature is older than maxAge, ErrSignatureExpired is
+// returned.
+func (t *TimestampSigner) Unsign(
+	signed string, maxAge time.Duration,
+) (string, error) {
+	value, _, err := t.UnsignTimestamp(signed, maxAge)
+	return value, errors.Trace(err)
+}
+
+// UnsignTimestamp is like Unsign but also returns when the value was signed.
+func (t *TimestampSigner) UnsignTimestamp(
+	signed string, maxAge time.Duration,
+) (string, time.Time, error) {
+	s := t.signer()
+	result, err := s.Unsign(signed)
+	if err != nil {
+		return "", time.Time{}, errors.Trace(err)
+	}
+
+	sep, _ := s.sep()
+	idx := strings.LastIndex(result, sep)
+	if idx == -1 {
+		return "", time.Time{}, errors.Annotate(ErrBadSignature, "no timestamp")
+	}
+	value := result[:idx]
+
+	ts, err := B62Decode(result[idx+len(sep):])
+	if err != nil {
+		return "", time.Time{}, errors.Annotate(ErrBadSignature, err.Error())
+	}
+	signedAt := time.Unix(ts, 0)
+
+	if maxAge != 0 {
+		age := time.Since(signedAt)
+		if age > maxAge {
+			return "", signedAt, errors.Annotatef(
+				ErrSignatureExpired, "signature age %s > %s", age, maxAge,
+			)
+		}
+	}
+
+	return value, signedAt, nil
+}
+
+func (t *TimestampSigner) SignObject(obj interface{}, compress bool) (string, error) {
+	payload, err := encodePayload(obj, compress)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return t.Sign(payload)
+}
+
+func (t *TimestampSigner) UnsignObject(
+	signed string, v interface{}, maxAge time.Duration,
+) error {
+	payload, err := t.Unsign(signed, maxAge)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(decodePayload(payload, v))
+}
+
+// Dumps is django.core.signing.dumps(), it returns a url safe, timestamped and
+// signed json serialization of obj. key defaults to amalgam.Secret and salt to
+// DefaultSalt.
+func Dumps(obj interface{}, key, salt string, compress bool) (string, error) {
+	if salt == "" {
+		salt = DefaultSalt
+	}
+	t := &TimestampSigner{Signer{Key: key, Salt: salt}}
+	return t.SignObject(obj, compress)
+}
+
+// Loads is django.core.signing.loads(), the reverse of Dumps(). A zero maxAge
+// accepts signatures of any age.
+func Loads(
+	signed string, v interface{}, key, salt string, maxAge time.Duration,
+	fallbackKeys ...string,
+) error {
+	if salt == "" {
+		salt = DefaultSalt
+	}
+	t := &TimestampSigner{
+		Signer{Key: key, Salt: salt, FallbackKeys: fallbackKeys},
+	}
+	return errors.Trace(t.UnsignObject(signed, v, maxAge))
+}
+
+// SaltedHMAC is django.utils.crypto.salted_hmac(), it returns the HMAC of
+// value using a key derived from keySalt and secret.
+func SaltedHMAC(
+	digest func() hash.Hash, keySalt, secret string, value []byte,
+) []byte {
+	h := digest()
+	h.Write([]byte(keySalt + secret))
+	key := h.Sum(nil)
+
+	mac := hmac.New(digest, key)
+	mac.Write(value)
+
+	return mac.Sum(nil)
+}
+
+func encodePayload(obj interface{}, compress bool) (string, error) {
+	data, err := serialize(obj)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	isCompressed := false
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return "", errors.Trace(err)
+		}
+		if err := w.Close(); err != nil {
+			return "", errors.Trace(err)
+		}
+		// only compress if it saves more than the "." prefix costs.
+		if buf.Len() < len(data)-1 {
+			data = buf.Bytes()
+			isCompressed = true
+		}
+	}
+
+	payload := b64Encode(data)
+	if isCompressed {
+		payload = "." + payload
+	}
+
+	return payload, nil
+}
+
+func decodePayload(payload string, v interface{}) error {
+	isCompressed := strings.HasPrefix(payload, ".")
+	if isCompressed {
+		payload = payload[1:]
+	}
+
+	data, err := b64Decode(payload)
+	if err != nil {
+		return errors.Annotate(ErrBadSignature, err.Error())
+	}
+
+	if isCompressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(json.Unmarshal(data, v))
+}
+
+// serialize matches django's JSONSerializer: compact separators, no html
+// escaping and non ascii characters escaped as \uXXXX.
+func serialize(obj interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		return nil, errors.Trace(err)
+	}
+	data := bytes.TrimRight(buf.Bytes(), "\n")
+
+	// json only produces non ascii bytes inside strings, so they can be
+	// escaped without parsing.
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r < utf8.RuneSelf:
+			out = append(out, data[0])
+		case r > 0xffff:
+			r -= 0x10000
+			out = append(out, fmt.Sprintf(
+				"\\u%04x\\u%04x", 0xd800+(r>>10), 0xdc00+(r&0x3ff),
+			)...)
+		default:
+			out = append(out, fmt.Sprintf("\\u%04x", r)...)
+		}
+		data = data[size:]
+	}
+
+	return out, nil
+}
+
+func b64Encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func b64Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,161 @@
+package signing
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestSignatureMatchesDjango(t *testing.T) {
+	cases := []struct {
+		signer    Signer
+		value     string
+		signature string
+	}{
+		// test_custom_algorithm in django's tests/signing/tests.py.
+		{
+			Signer{Key: "predictable-secret", Algorithm: "sha512"}, "hello",
+			"Usf3uVQOZ9m6uPfVonKR-EBXjPe7bjMbp3_Fq8MfsptgkkM1ojidN0BxYaT5HAEN1VzO9_jVu7R-VkqknHYNvw",
+		},
+		{
+			Signer{Key: "predictable-secret"}, "hello",
+			"T8oWtiMIRTzcoR3NRO-2PQNf5dTweZy0EL25Kt6lUo0",
+		},
+		{
+			Signer{Key: "predictable-secret", Salt: "extra-salt"}, "hello",
+			"g8YZrsJ1xXg4hGFgU2uc4ff9ZZRKt3ReprMkjND8TfM",
+		},
+	}
+
+	for _, c := range cases {
+		sig, err := c.signer.Signature(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig != c.signature {
+			t.Errorf("%+v: got %s, want %s", c.signer, sig, c.signature)
+		}
+
+		value, err := c.signer.Unsign(c.value + ":" + c.signature)
+		if err != nil || value != c.value {
+			t.Errorf("%+v: Unsign() = %q, %v", c.signer, value, err)
+		}
+	}
+}
+
+func TestUnsignFallbackKeys(t *testing.T) {
+	s := Signer{Key: "new-secret", FallbackKeys: []string{"predictable-secret"}}
+	value, err := s.Unsign("hello:T8oWtiMIRTzcoR3NRO-2PQNf5dTweZy0EL25Kt6lUo0")
+	if err != nil || value != "hello" {
+		t.Errorf("Unsign() = %q, %v", value, err)
+	}
+
+	s = Signer{Key: "new-secret"}
+	_, err = s.Unsign("hello:T8oWtiMIRTzcoR3NRO-2PQNf5dTweZy0EL25Kt6lUo0")
+	if errors.Cause(err) != ErrBadSignature {
+		t.Errorf("Unsign() without fallback = %v", err)
+	}
+}
+
+// signedAt is the time django's TimestampSigner tests freeze time at.
+var signedAt = time.Unix(123456789, 0)
+
+func TestTimestampSignerMatchesDjango(t *testing.T) {
+	signed := "hello:8M0kX:0pJB1_TN9Bno2aK29thnZKKHn76ngzcQVnIrp_DNs5M"
+
+	if ts := B62Encode(signedAt.Unix()); ts != "8M0kX" {
+		t.Errorf("B62Encode() = %s", ts)
+	}
+
+	ts := &TimestampSigner{Signer{Key: "predictable-key"}}
+	value, at, err := ts.UnsignTimestamp(signed, 0)
+	if err != nil || value != "hello" || !at.Equal(signedAt) {
+		t.Errorf("UnsignTimestamp() = %q, %v, %v", value, at, err)
+	}
+
+	_, err = ts.Unsign(signed, time.Hour)
+	if errors.Cause(err) != ErrSignatureExpired {
+		t.Errorf("Unsign() of an old value = %v", err)
+	}
+}
+
+func TestLoadsDjangoDumps(t *testing.T) {
+	cases := []struct {
+		signed string
+		salt   string
+		value  interface{}
+	}{
+		{
+			"eyJhIjoiYSBzdHJpbmcgXHUyMDIwIiwiYiI6WzEsMl19:8M0kX:FE2LJmFY4pKzu_NDFm6HfMlhrNEKhCupMDD-0Rpi9jE",
+			"",
+			map[string]interface{}{
+				"a": "a string †", "b": []interface{}{1.0, 2.0},
+			},
+		},
+		{
+			".eJxTSqQDUAIArdsmKQ:8M0kX:bOp2NSWv-DwIM4fCdlbEzR1GtRoxNeHfnIsmnWfKsr4",
+			"",
+			strings.Repeat("a", 100),
+		},
+		{
+			".eJyrVkpUslKqIBko6SjlKVnllebk6CiVKFmVFJWm1gIA0zcfPQ:8M0kX:Rr1yu7DI6zbGpmyrF6YH3Ach2noptpS7fEORpyFiPxY",
+			"custom",
+			map[string]interface{}{
+				"a": strings.Repeat("x", 50),
+				"n": nil, "t": true,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		var v interface{}
+		if err := Loads(c.signed, &v, "predictable-key", c.salt, 0); err != nil {
+			t.Errorf("%s: %v", c.signed, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, c.value) {
+			t.Errorf("%s: got %#v, want %#v", c.signed, v, c.value)
+		}
+
+		err := Loads(c.signed, &v, "other-key", c.salt, 0)
+		if errors.Cause(err) != ErrBadSignature {
+			t.Errorf("%s: Loads() with the wrong key = %v", c.signed, err)
+		}
+	}
+}
+
+func TestDumpsMatchesDjango(t *testing.T) {
+	// dumps() with the timestamp of the value above, zlib output is not
+	// compared as it differs between implementations.
+	obj := map[string]interface{}{"a": "a string †", "b": []int{1, 2}}
+	payload, err := encodePayload(obj, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Signer{Key: "predictable-key", Salt: DefaultSalt}
+	signed, err := s.Sign(payload + ":" + B62Encode(signedAt.Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "eyJhIjoiYSBzdHJpbmcgXHUyMDIwIiwiYiI6WzEsMl19:8M0kX:FE2LJmFY4pKzu_NDFm6HfMlhrNEKhCupMDD-0Rpi9jE"
+	if signed != want {
+		t.Errorf("got %s, want %s", signed, want)
+	}
+
+	signed, err = Dumps([]string{"round", "trip"}, "predictable-key", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []string
+	if err := Loads(signed, &v, "predictable-key", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, []string{"round", "trip"}) {
+		t.Errorf("round trip = %v", v)
+	}
+}
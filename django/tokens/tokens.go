@@ -0,0 +1,263 @@
+// Package tokens is a go port of django.contrib.auth.tokens. Password reset
+// links made here work with django's PasswordResetConfirmView and the other
+// way round, as long as both sides use the same secret and time zone.
+package tokens
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/signing"
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrInvalidToken is returned by Verify() for unknown users and for
+	// tokens that are malformed, expired or already used.
+	ErrInvalidToken     = errors.New("invalid password reset token")
+	ErrUnknownAlgorithm = errors.New("unknown hash algorithm")
+)
+
+const (
+	// DefaultTimeout is django's default PASSWORD_RESET_TIMEOUT, three days.
+	DefaultTimeout = time.Hour * 24 * 3
+	keySalt        = "django.contrib.auth.tokens.PasswordResetTokenGenerator"
+)
+
+// epoch is the day django counts token timestamps from.
+var epoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// PasswordResetTokenGenerator is
+// django.contrib.auth.tokens.PasswordResetTokenGenerator. The zero value makes
+// the tokens of a default django project with TIME_ZONE set to UTC.
+//
+// Tokens are tied to the password hash, last_login and email of the user, so
+// they stop working once the password is changed or the user logs in.
+type PasswordResetTokenGenerator struct {
+	// Key defaults to amalgam.Secret.
+	Key string
+	// FallbackKeys are also accepted by CheckToken(), like django's
+	// SECRET_KEY_FALLBACKS.
+	FallbackKeys []string
+	// Algorithm is "sha256" (the default) or "sha1", which django before 4.0
+	// used with DEFAULT_HASHING_ALGORITHM = "sha1".
+	Algorithm string
+	// AcceptSHA1 also accepts tokens made with sha1, like django 3.1 did while
+	// projects moved to sha256.
+	AcceptSHA1 bool
+	// Timeout is PASSWORD_RESET_TIMEOUT, defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Location is django's TIME_ZONE, token timestamps are taken from the
+	// wall clock there. Defaults to UTC.
+	Location *time.Location
+	// EmailField is the EMAIL_FIELD of the user model, defaults to "email".
+	EmailField string
+}
+
+func (g *PasswordResetTokenGenerator) keys() []string {
+	key := g.Key
+	if key == "" {
+		key = amalgam.Secret
+	}
+	return append([]string{key}, g.FallbackKeys...)
+}
+
+func (g *PasswordResetTokenGenerator) digests() ([]func() hash.Hash, error) {
+	switch g.Algorithm {
+	case "", "sha256":
+		if g.AcceptSHA1 {
+			return []func() hash.Hash{sha256.New, sha1.New}, nil
+		}
+		return []func() hash.Hash{sha256.New}, nil
+	case "sha1":
+		return []func() hash.Hash{sha1.New}, nil
+	}
+	return nil, errors.Annotate(ErrUnknownAlgorithm, g.Algorithm)
+}
+
+func (g *PasswordResetTokenGenerator) timeout() time.Duration {
+	if g.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return g.Timeout
+}
+
+func (g *PasswordResetTokenGenerator) emailField() string {
+	if g.EmailField == "" {
+		return "email"
+	}
+	return g.EmailField
+}
+
+// numSeconds is _num_seconds(_now()), django takes the naive local time.
+func (g *PasswordResetTokenGenerator) numSeconds(t time.Time) int64 {
+	loc := g.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	t = t.In(loc)
+	naive := time.Date(
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0,
+		time.UTC,
+	)
+	return int64(naive.Sub(epoch) / time.Second)
+}
+
+// MakeToken returns a token that can be used once to reset the password of
+// user.
+func (g *PasswordResetTokenGenerator) MakeToken(user django.User) (string, error) {
+	digests, err := g.digests()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	ts := g.numSeconds(time.Now())
+	return g.makeToken(user, ts, g.keys()[0], digests[0]), nil
+}
+
+func (g *PasswordResetTokenGenerator) makeToken(
+	user django.User, ts int64, key string, digest func() hash.Hash,
+) string {
+	sum := hex.EncodeToString(
+		signing.SaltedHMAC(digest, keySalt, key, []byte(g.hashValue(user, ts))),
+	)
+
+	// django only keeps every other character, to make urls shorter.
+	short := make([]byte, 0, len(sum)/2)
+	for i := 0; i < len(sum); i += 2 {
+		short = append(short, sum[i])
+	}
+
+	return strconv.FormatInt(ts, 36) + "-" + string(short)
+}
+
+// hashValue is _make_hash_value().
+func (g *PasswordResetTokenGenerator) hashValue(user django.User, ts int64) string {
+	lastLogin := ""
+	switch t := fieldOf(user, "last_login").(type) {
+	case time.Time:
+		lastLogin = t.UTC().Format("2006-01-02 15:04:05")
+	case *time.Time:
+		if t != nil {
+			lastLogin = t.UTC().Format("2006-01-02 15:04:05")
+		}
+	}
+
+	return fmt.Sprintf(
+		"%d%s%s%d%s", user.ID(), stringField(user, "password"), lastLogin, ts,
+		stringField(user, g.emailField()),
+	)
+}
+
+// CheckToken returns true if token was made for user by MakeToken() or by
+// django, and has not expired.
+func (g *PasswordResetTokenGenerator) CheckToken(user django.User, token string) bool {
+	if user == nil || token == "" {
+		return false
+	}
+
+	parts := strings.Split(token, "-")
+	if len(parts) != 2 || len(parts[0]) > 13 {
+		return false
+	}
+	ts, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return false
+	}
+
+	digests, err := g.digests()
+	if err != nil {
+		return false
+	}
+
+	valid := false
+	for _, key := range g.keys() {
+		for _, digest := range digests {
+			expected := g.makeToken(user, ts, key, digest)
+			if hmac.Equal([]byte(expected), []byte(token)) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return false
+	}
+
+	age := g.numSeconds(time.Now()) - ts
+	return age <= int64(g.timeout()/time.Second)
+}
+
+// Verify returns the user of a password reset link made by django or by
+// MakeToken() and EncodeUID().
+func (g *PasswordResetTokenGenerator) Verify(
+	ctx context.Context, users django.UserStore, uidb64, token string,
+) (django.User, error) {
+	id, err := DecodeUID(uidb64)
+	if err != nil {
+		return nil, errors.Annotate(ErrInvalidToken, err.Error())
+	}
+
+	user, err := users.UserByID(ctx, id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotate(ErrInvalidToken, "no such user")
+		}
+		return nil, errors.Trace(err)
+	}
+
+	if !g.CheckToken(user, token) {
+		return nil, errors.Trace(ErrInvalidToken)
+	}
+
+	return user, nil
+}
+
+// EncodeUID is urlsafe_base64_encode(force_bytes(user.pk)), the uidb64 of
+// password reset links.
+func EncodeUID(id int64) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(id, 10)),
+	)
+}
+
+// DecodeUID reverses EncodeUID(), padding is optional like in django.
+func DecodeUID(uidb64 string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(uidb64, "="))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return id, nil
+}
+
+func fieldOf(user django.User, name string) interface{} {
+	v, _ := user.Field(name)
+	return v
+}
+
+func stringField(user django.User, name string) string {
+	switch v := fieldOf(user, name).(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package tokens
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"testing"
+	"time"
+
+	"github.com/amitu/amalgam/django"
+)
+
+// fakeUser has the fields django hashes into password reset tokens.
+type fakeUser struct {
+	django.User
+	id     int64
+	fields map[string]interface{}
+}
+
+func (u *fakeUser) ID() int64 { return u.id }
+
+func (u *fakeUser) Field(name string) (interface{}, bool) {
+	v, ok := u.fields[name]
+	return v, ok
+}
+
+func newUser(lastLogin interface{}) *fakeUser {
+	return &fakeUser{id: 42, fields: map[string]interface{}{
+		"password":   "pbkdf2_sha256$1000000$seasalt$r1uLUxoxpP2Ued/qxvmje7UH9PUJBkRrvf9gGPL7Cps=",
+		"email":      "jane@example.com",
+		"last_login": lastLogin,
+	}}
+}
+
+// ts is the _num_seconds() of the tokens below.
+const ts = 800000000
+
+func TestMakeTokenMatchesDjango(t *testing.T) {
+	lastLogin := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+
+	cases := []struct {
+		user   django.User
+		key    string
+		digest func() hash.Hash
+		token  string
+	}{
+		{
+			newUser(nil), "predictable-secret", sha256.New,
+			"d8ary8-1ec8d224329f767e9c5c641ef006069d",
+		},
+		{
+			newUser(&lastLogin), "predictable-secret", sha256.New,
+			"d8ary8-313eeef3c133488d2a5fd6783211108f",
+		},
+		{
+			newUser(nil), "predictable-secret", sha1.New,
+			"d8ary8-05cbf68c0b95081f49aa",
+		},
+		{
+			newUser(nil), "old-secret", sha256.New,
+			"d8ary8-07546a3a799e75335d1f27974d544c9f",
+		},
+	}
+
+	g := &PasswordResetTokenGenerator{}
+	for _, c := range cases {
+		if token := g.makeToken(c.user, ts, c.key, c.digest); token != c.token {
+			t.Errorf("got %s, want %s", token, c.token)
+		}
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	// long enough for the fixed timestamp above to be valid.
+	forever := time.Hour * 24 * 365 * 100
+
+	cases := []struct {
+		g     *PasswordResetTokenGenerator
+		token string
+		valid bool
+	}{
+		{
+			&PasswordResetTokenGenerator{Key: "predictable-secret", Timeout: forever},
+			"d8ary8-1ec8d224329f767e9c5c641ef006069d", true,
+		},
+		{
+			&PasswordResetTokenGenerator{
+				Key: "new-secret", FallbackKeys: []string{"old-secret"},
+				Timeout: forever,
+			},
+			"d8ary8-07546a3a799e75335d1f27974d544c9f", true,
+		},
+		{
+			&PasswordResetTokenGenerator{Key: "predictable-secret", Timeout: forever},
+			"d8ary8-05cbf68c0b95081f49aa", false,
+		},
+		{
+			&PasswordResetTokenGenerator{
+				Key: "predictable-secret", AcceptSHA1: true, Timeout: forever,
+			},
+			"d8ary8-05cbf68c0b95081f49aa", true,
+		},
+		{
+			// expired with the default timeout.
+			&PasswordResetTokenGenerator{Key: "predictable-secret"},
+			"d8ary8-1ec8d224329f767e9c5c641ef006069d", false,
+		},
+		{
+			&PasswordResetTokenGenerator{Key: "predictable-secret", Timeout: forever},
+			"d8ary8-1ec8d224329f767e9c5c641ef006069e", false,
+		},
+	}
+
+	for _, c := range cases {
+		if valid := c.g.CheckToken(newUser(nil), c.token); valid != c.valid {
+			t.Errorf("%s: CheckToken() = %v, want %v", c.token, valid, c.valid)
+		}
+	}
+
+	// logging in invalidates the token.
+	lastLogin := time.Now()
+	g := cases[0].g
+	if g.CheckToken(newUser(&lastLogin), cases[0].token) {
+		t.Error("token accepted after login")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	g := &PasswordResetTokenGenerator{Key: "predictable-secret"}
+	user := newUser(nil)
+
+	token, err := g.MakeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.CheckToken(user, token) {
+		t.Errorf("%s not accepted", token)
+	}
+}
+
+func TestUID(t *testing.T) {
+	// urlsafe_base64_encode(force_bytes(42)).
+	if uid := EncodeUID(42); uid != "NDI" {
+		t.Errorf("EncodeUID() = %s", uid)
+	}
+
+	for _, uid := range []string{"NDI", "NDI="} {
+		if id, err := DecodeUID(uid); err != nil || id != 42 {
+			t.Errorf("DecodeUID(%s) = %d, %v", uid, id, err)
+		}
+	}
+}
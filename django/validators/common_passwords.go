@@ -0,0 +1,38 @@
+package validators
+
+import (
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// commonPasswordsGz is the list the zero CommonPasswordValidator uses. go
+// generate replaces it with django's django/contrib/auth/common-passwords.txt.gz,
+// which must be committed for the validator to reject what django rejects.
+//
+//go:generate curl -sSfL -o common-passwords.txt.gz https://raw.githubusercontent.com/django/django/main/django/contrib/auth/common-passwords.txt.gz
+//go:embed common-passwords.txt.gz
+var commonPasswordsGz []byte
+
+var (
+	bundledOnce            sync.Once
+	bundledCommonPasswords map[string]bool
+)
+
+// bundled returns the embedded passwords, they are read on first use.
+func bundled() map[string]bool {
+	bundledOnce.Do(func() {
+		gz, err := gzip.NewReader(bytes.NewReader(commonPasswordsGz))
+		if err == nil {
+			defer gz.Close()
+			bundledCommonPasswords, err = readCommonPasswords(gz)
+		}
+		if err != nil {
+			panic(errors.Annotate(err, "bad common-passwords.txt.gz"))
+		}
+	})
+	return bundledCommonPasswords
+}
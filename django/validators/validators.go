@@ -0,0 +1,328 @@
+// Package validators checks passwords the way django's AUTH_PASSWORD_VALIDATORS
+// do. Errors carry django's codes and messages, so a form shows the same
+// errors whether django or go validated it.
+package validators
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// Validator is one entry of AUTH_PASSWORD_VALIDATORS. user may be nil, for
+// example when a user is being created.
+type Validator interface {
+	// Validate returns nothing if password is acceptable.
+	Validate(password string, user django.User) []amalgam.AError
+	// HelpText describes what Validate accepts.
+	HelpText() string
+}
+
+// DefaultValidators are the validators django's startproject enables.
+func DefaultValidators() []Validator {
+	return []Validator{
+		&UserAttributeSimilarityValidator{},
+		&MinimumLengthValidator{},
+		&CommonPasswordValidator{},
+		&NumericPasswordValidator{},
+	}
+}
+
+// ValidatePassword is django's validate_password(), it returns the errors of
+// all validators. DefaultValidators() are used if validators is empty.
+func ValidatePassword(
+	password string, user django.User, validators ...Validator,
+) []amalgam.AError {
+	if len(validators) == 0 {
+		validators = DefaultValidators()
+	}
+
+	errs := []amalgam.AError{}
+	for _, v := range validators {
+		errs = append(errs, v.Validate(password, user)...)
+	}
+	return errs
+}
+
+// HelpTexts is django's password_validators_help_texts().
+func HelpTexts(validators ...Validator) []string {
+	if len(validators) == 0 {
+		validators = DefaultValidators()
+	}
+
+	texts := []string{}
+	for _, v := range validators {
+		texts = append(texts, v.HelpText())
+	}
+	return texts
+}
+
+// MinimumLengthValidator rejects passwords shorter than MinLength, which
+// defaults to 8.
+type MinimumLengthValidator struct {
+	MinLength int
+}
+
+func (v *MinimumLengthValidator) minLength() int {
+	if v.MinLength == 0 {
+		return 8
+	}
+	return v.MinLength
+}
+
+func (v *MinimumLengthValidator) Validate(
+	password string, _ django.User,
+) []amalgam.AError {
+	n := v.minLength()
+	if len([]rune(password)) >= n {
+		return nil
+	}
+
+	return []amalgam.AError{{
+		Human: fmt.Sprintf(
+			"This password is too short. It must contain at least %d %s.",
+			n, plural(n, "character", "characters"),
+		),
+		Code:    "password_too_short",
+		Context: map[string]interface{}{"min_length": n},
+	}}
+}
+
+func (v *MinimumLengthValidator) HelpText() string {
+	n := v.minLength()
+	return fmt.Sprintf(
+		"Your password must contain at least %d %s.",
+		n, plural(n, "character", "characters"),
+	)
+}
+
+// UserAttributeSimilarityValidator rejects passwords too similar to the
+// username, name or email of the user.
+type UserAttributeSimilarityValidator struct {
+	// UserAttributes default to username, first_name, last_name and email.
+	UserAttributes []string
+	// MaxSimilarity defaults to 0.7, django refuses values below 0.1.
+	MaxSimilarity float64
+}
+
+func (v *UserAttributeSimilarityValidator) attributes() []string {
+	if len(v.UserAttributes) == 0 {
+		return []string{"username", "first_name", "last_name", "email"}
+	}
+	return v.UserAttributes
+}
+
+func (v *UserAttributeSimilarityValidator) maxSimilarity() float64 {
+	if v.MaxSimilarity == 0 {
+		return 0.7
+	}
+	return v.MaxSimilarity
+}
+
+func (v *UserAttributeSimilarityValidator) Validate(
+	password string, user django.User,
+) []amalgam.AError {
+	if user == nil {
+		return nil
+	}
+
+	maxSimilarity := v.maxSimilarity()
+	lowered := strings.ToLower(password)
+
+	for _, attr := range v.attributes() {
+		var value string
+		switch f, _ := user.Field(attr); val := f.(type) {
+		case string:
+			value = val
+		case []byte:
+			value = string(val)
+		}
+		if value == "" {
+			continue
+		}
+
+		parts := append(strings.FieldsFunc(value, isNotWordChar), value)
+		for _, part := range parts {
+			if exceedsMaximumLengthRatio(password, maxSimilarity, part) {
+				continue
+			}
+			if quickRatio(lowered, strings.ToLower(part)) < maxSimilarity {
+				continue
+			}
+
+			name := verboseName(attr)
+			return []amalgam.AError{{
+				Human:   "The password is too similar to the " + name + ".",
+				Code:    "password_too_similar",
+				Context: map[string]interface{}{"verbose_name": name},
+			}}
+		}
+	}
+
+	return nil
+}
+
+func (v *UserAttributeSimilarityValidator) HelpText() string {
+	return "Your password can’t be too similar to your other personal information."
+}
+
+// verboseName is the verbose_name django gives the fields of its user model.
+func verboseName(attr string) string {
+	if attr == "email" {
+		return "email address"
+	}
+	return strings.Replace(attr, "_", " ", -1)
+}
+
+// isNotWordChar matches python's \W.
+func isNotWordChar(r rune) bool {
+	return !(unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_')
+}
+
+// exceedsMaximumLengthRatio skips values so much shorter than the password
+// that they can not reach maxSimilarity, like django does.
+func exceedsMaximumLengthRatio(
+	password string, maxSimilarity float64, value string,
+) bool {
+	pwdLen := len([]rune(password))
+	valueLen := len([]rune(value))
+	return pwdLen >= 10*valueLen &&
+		float64(valueLen) < maxSimilarity/2*float64(pwdLen)
+}
+
+// quickRatio is python's difflib.SequenceMatcher(a=a, b=b).quick_ratio().
+func quickRatio(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)+len(rb) == 0 {
+		return 1
+	}
+
+	avail := map[rune]int{}
+	for _, r := range rb {
+		avail[r]++
+	}
+
+	matches := 0
+	for _, r := range ra {
+		if avail[r] > 0 {
+			avail[r]--
+			matches++
+		}
+	}
+
+	return 2 * float64(matches) / float64(len(ra)+len(rb))
+}
+
+// CommonPasswordValidator rejects common passwords. The zero value uses the
+// embedded common-passwords.txt.gz, use LoadCommonPasswords() for another
+// list, like the one of the django version the project runs.
+type CommonPasswordValidator struct {
+	Passwords map[string]bool
+}
+
+// LoadCommonPasswords reads a list with one password per line, like django's
+// django/contrib/auth/common-passwords.txt.gz. Files ending in .gz are
+// decompressed.
+func LoadCommonPasswords(path string) (*CommonPasswordValidator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	passwords, err := readCommonPasswords(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &CommonPasswordValidator{Passwords: passwords}, nil
+}
+
+// readCommonPasswords reads one password per line, lower cased like the
+// passwords they are checked against.
+func readCommonPasswords(r io.Reader) (map[string]bool, error) {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		password := strings.TrimSpace(strings.ToLower(scanner.Text()))
+		if password != "" {
+			passwords[password] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return passwords, nil
+}
+
+func (v *CommonPasswordValidator) Validate(
+	password string, _ django.User,
+) []amalgam.AError {
+	passwords := v.Passwords
+	if passwords == nil {
+		passwords = bundled()
+	}
+
+	if !passwords[strings.TrimSpace(strings.ToLower(password))] {
+		return nil
+	}
+
+	return []amalgam.AError{{
+		Human: "This password is too common.",
+		Code:  "password_too_common",
+	}}
+}
+
+func (v *CommonPasswordValidator) HelpText() string {
+	return "Your password can’t be a commonly used password."
+}
+
+// NumericPasswordValidator rejects passwords made of digits only.
+type NumericPasswordValidator struct{}
+
+func (v *NumericPasswordValidator) Validate(
+	password string, _ django.User,
+) []amalgam.AError {
+	if password == "" || strings.IndexFunc(password, isNotDigit) != -1 {
+		return nil
+	}
+
+	return []amalgam.AError{{
+		Human: "This password is entirely numeric.",
+		Code:  "password_entirely_numeric",
+	}}
+}
+
+func (v *NumericPasswordValidator) HelpText() string {
+	return "Your password can’t be entirely numeric."
+}
+
+func isNotDigit(r rune) bool {
+	return !unicode.IsDigit(r)
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,214 @@
+package validators
+
+import (
+	"compress/gzip"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+)
+
+type fakeUser struct {
+	django.User
+	fields map[string]interface{}
+}
+
+func (u *fakeUser) Field(name string) (interface{}, bool) {
+	v, ok := u.fields[name]
+	return v, ok
+}
+
+var jane = &fakeUser{fields: map[string]interface{}{
+	"username":   "jdoe",
+	"first_name": "Jane",
+	"last_name":  "Doe",
+	"email":      "jane.doe@example.com",
+}}
+
+func codes(errs []amalgam.AError) []string {
+	codes := []string{}
+	for _, e := range errs {
+		codes = append(codes, e.Code)
+	}
+	return codes
+}
+
+func TestQuickRatioMatchesDifflib(t *testing.T) {
+	// SequenceMatcher(a=a, b=b).quick_ratio() of python 3.11.
+	cases := []struct {
+		a, b  string
+		ratio float64
+	}{
+		{"abcd", "bcda", 1},
+		{"password", "passport", 0.75},
+		{"", "", 1},
+		{"héllo", "hello", 0.8},
+		{"jane.doe", "janedoe123", 0.7777777777777778},
+		{"abc", "xyz", 0},
+		{"aab", "abb", 0.6666666666666666},
+	}
+
+	for _, c := range cases {
+		if r := quickRatio(c.a, c.b); math.Abs(r-c.ratio) > 1e-12 {
+			t.Errorf("quickRatio(%q, %q) = %v, want %v", c.a, c.b, r, c.ratio)
+		}
+	}
+}
+
+func TestExceedsMaximumLengthRatio(t *testing.T) {
+	cases := []struct {
+		password, value string
+		exceeds         bool
+	}{
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "abc", true},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "abcdefghijk", false},
+		{"aaaaaaaaaaaaaaaaaaaa", "ab", true},
+		{"aaaaaaaaa", "a", false},
+	}
+
+	for _, c := range cases {
+		got := exceedsMaximumLengthRatio(c.password, 0.7, c.value)
+		if got != c.exceeds {
+			t.Errorf("%q, %q: got %v", c.password, c.value, got)
+		}
+	}
+}
+
+func TestUserAttributeSimilarity(t *testing.T) {
+	// what django's validator says for jane, worked out with difflib.
+	cases := []struct {
+		password string
+		similar  string
+	}{
+		{"JaneDoe!", ""},
+		{"doe12345", ""},
+		{"example.com", "email address"},
+		{"Tr0ub4dor&3", ""},
+		{"jdoe1", "username"},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", ""},
+	}
+
+	v := &UserAttributeSimilarityValidator{}
+	for _, c := range cases {
+		errs := v.Validate(c.password, jane)
+		if c.similar == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s: %v", c.password, errs)
+			}
+			continue
+		}
+
+		want := "The password is too similar to the " + c.similar + "."
+		if len(errs) != 1 || errs[0].Human != want ||
+			errs[0].Code != "password_too_similar" {
+			t.Errorf("%s: %v", c.password, errs)
+		}
+	}
+
+	if errs := v.Validate("jdoe1", nil); len(errs) != 0 {
+		t.Errorf("without a user: %v", errs)
+	}
+}
+
+func TestMinimumLength(t *testing.T) {
+	errs := (&MinimumLengthValidator{}).Validate("short", nil)
+	want := "This password is too short. It must contain at least 8 characters."
+	if len(errs) != 1 || errs[0].Human != want ||
+		errs[0].Code != "password_too_short" {
+		t.Errorf("got %v", errs)
+	}
+
+	// runes are counted, like python counts characters.
+	errs = (&MinimumLengthValidator{}).Validate("ééééééé1", nil)
+	if len(errs) != 0 {
+		t.Errorf("got %v", errs)
+	}
+
+	v := &MinimumLengthValidator{MinLength: 1}
+	errs = v.Validate("", nil)
+	want = "This password is too short. It must contain at least 1 character."
+	if len(errs) != 1 || errs[0].Human != want {
+		t.Errorf("got %v", errs)
+	}
+	want = "Your password must contain at least 1 character."
+	if text := v.HelpText(); text != want {
+		t.Errorf("HelpText() = %s", text)
+	}
+}
+
+func TestNumericPassword(t *testing.T) {
+	v := &NumericPasswordValidator{}
+	if c := codes(v.Validate("12345678", nil)); len(c) != 1 ||
+		c[0] != "password_entirely_numeric" {
+		t.Errorf("got %v", c)
+	}
+	for _, password := range []string{"", "1234567a"} {
+		if errs := v.Validate(password, nil); len(errs) != 0 {
+			t.Errorf("%q: %v", password, errs)
+		}
+	}
+}
+
+func TestCommonPasswords(t *testing.T) {
+	v := &CommonPasswordValidator{}
+	for _, password := range []string{"password", " PassWord ", "qwerty"} {
+		errs := v.Validate(password, nil)
+		if len(errs) != 1 || errs[0].Code != "password_too_common" ||
+			errs[0].Human != "This password is too common." {
+			t.Errorf("%q: %v", password, errs)
+		}
+	}
+	if errs := v.Validate("x8#kQ!v2zz", nil); len(errs) != 0 {
+		t.Errorf("got %v", errs)
+	}
+}
+
+func TestLoadCommonPasswords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "common-passwords.txt.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("Hunter2\n  letmein  \n\n"))
+	gz.Close()
+	f.Close()
+
+	v, err := LoadCommonPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Passwords) != 2 {
+		t.Fatalf("loaded %v", v.Passwords)
+	}
+	for _, password := range []string{"hunter2", "HUNTER2", "LetMeIn"} {
+		if len(v.Validate(password, nil)) != 1 {
+			t.Errorf("%s accepted", password)
+		}
+	}
+	if len(v.Validate("password", nil)) != 0 {
+		t.Error("loaded list not used")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	got := codes(ValidatePassword("12345", jane))
+	want := []string{
+		"password_too_short", "password_too_common", "password_entirely_numeric",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	if n := len(HelpTexts()); n != 4 {
+		t.Errorf("%d help texts", n)
+	}
+}
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/phonelogin"
+	"github.com/juju/errors"
+)
+
+// Login stores user in the session of the request the way django's
+// contrib.auth.login() does, so django sees the same user logged in. The
+// session key is rotated to prevent session fixation, unless the session
+// already belongs to the user, last_login is updated and the CSRF token is
+// rotated.
+func Login(ctx context.Context, w http.ResponseWriter, user django.User) error {
+	rs := ctx2RequestSession(ctx)
+	if rs == nil {
+		return errors.Trace(ErrNoSession)
+	}
+
+	session, err := rs.get(ctx)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return errors.Trace(err)
+	}
+	rs.session = session
+
+	uid := strconv.FormatInt(user.ID(), 10)
+	authHash := session.Store().SessionAuthHash(user)
+
+	if current, err := session.GetValue(django.KeyUserID); err == nil {
+		hash, _ := session.GetString(django.KeyUserHash)
+		if !sameUserID(current, uid) ||
+			!hmac.Equal([]byte(hash), []byte(authHash)) {
+			// another user, or a stale login of this one.
+			if err := session.Flush(ctx); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	} else {
+		if err := session.CycleKey(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	values := []struct {
+		key   string
+		value string
+	}{
+		{django.KeyUserID, uid},
+		{django.KeyUserBackend, django.ModelBackend},
+		{django.KeyUserHash, authHash},
+	}
+	for _, v := range values {
+		if err := session.SetValue(ctx, v.key, v.value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := user.UpdateLastLogin(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if rc := ctx2RequestCSRF(ctx); rc != nil {
+		if err := RotateCSRFToken(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		sendCSRFCookie(w, rc)
+	}
+
+	if ru := ctx2RequestUser(ctx); ru != nil {
+		ru.set(user, session)
+	}
+
+	sendSessionCookie(w, rs)
+	amalgam.LOGGER.Debug("user_logged_in", "user", user.ID())
+	return nil
+}
+
+// LoginWithPhoneCode verifies code sent to phone by codes.RequestCode() and
+// logs the user with that phone in with Login().
+func LoginWithPhoneCode(
+	ctx context.Context, w http.ResponseWriter, codes phonelogin.Store,
+	phone, code string,
+) (django.User, error) {
+	user, err := codes.VerifyCode(ctx, phone, code)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := Login(ctx, w, user); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return user, nil
+}
+
+// Logout removes the user from the session of the request by flushing the
+// whole session, like django's contrib.auth.logout(). The session cookie is
+// deleted.
+func Logout(ctx context.Context, w http.ResponseWriter) error {
+	rs := ctx2RequestSession(ctx)
+	if rs == nil {
+		return errors.Trace(ErrNoSession)
+	}
+
+	session, err := rs.get(ctx)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return errors.Trace(err)
+	}
+	rs.session = session
+
+	if err := session.Flush(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if ru := ctx2RequestUser(ctx); ru != nil {
+		ru.set(nil, nil)
+	}
+
+	sendSessionCookie(w, rs)
+	return nil
+}
+
+// sameUserID compares a stored _auth_user_id, which django keeps as a json
+// string and older code kept as a number, with uid.
+func sameUserID(stored []byte, uid string) bool {
+	return string(stored) == uid || string(stored) == strconv.Quote(uid)
+}
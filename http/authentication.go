@@ -0,0 +1,264 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+const (
+	KeyRequestUser = "http-request-user"
+)
+
+// Authenticator identifies the user making a request, like the authentication
+// classes of django rest framework. Authenticate() returns the user and, like
+// request.auth in django rest framework, what they authenticated with. It
+// returns neither and no error if the request carries no credentials it
+// understands, so the next authenticator is tried, and an error wrapping
+// django.ErrInvalidCredentials if the credentials are wrong. Credentials that
+// belong to no user, like OAuth2 client credentials tokens, are returned
+// without a user.
+type Authenticator interface {
+	Authenticate(
+		ctx context.Context, r *http.Request,
+	) (django.User, interface{}, error)
+	// NeedsCSRF() reports if browsers send the credentials on their own, like
+	// cookies, so requests authenticated this way must pass the CSRF check.
+	NeedsCSRF() bool
+}
+
+// SessionAuthenticator authenticates the user logged in to the session.
+type SessionAuthenticator struct{}
+
+// Authenticate returns the session as the credentials.
+func (a *SessionAuthenticator) Authenticate(
+	ctx context.Context, _ *http.Request,
+) (django.User, interface{}, error) {
+	rs := ctx2RequestSession(ctx)
+	if rs == nil {
+		return nil, nil, nil
+	}
+
+	session, err := rs.get(ctx)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Trace(err)
+	}
+
+	user, err := session.GetUser(ctx)
+	if err != nil {
+		cause := errors.Cause(err)
+		if cause == django.ErrNoUser || cause == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Trace(err)
+	}
+
+	return user, session, nil
+}
+
+func (a *SessionAuthenticator) NeedsCSRF() bool {
+	return true
+}
+
+// TokenAuthenticator is django rest framework's TokenAuthentication, it reads
+// "Authorization: Token <key>" headers.
+type TokenAuthenticator struct {
+	Users django.UserStore
+	// Keyword defaults to "Token".
+	Keyword string
+}
+
+// Authenticate returns the token as the credentials.
+func (a *TokenAuthenticator) Authenticate(
+	ctx context.Context, r *http.Request,
+) (django.User, interface{}, error) {
+	keyword := a.Keyword
+	if keyword == "" {
+		keyword = "Token"
+	}
+
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) == 0 || !strings.EqualFold(parts[0], keyword) {
+		return nil, nil, nil
+	}
+	if len(parts) != 2 {
+		return nil, nil, errors.Annotate(
+			django.ErrInvalidCredentials, "invalid token header",
+		)
+	}
+
+	user, err := activeUser(a.Users.UserByToken(ctx, parts[1]))
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "invalid token")
+	}
+	return user, parts[1], nil
+}
+
+func (a *TokenAuthenticator) NeedsCSRF() bool {
+	return false
+}
+
+// APIKeyAuthenticator authenticates requests with an API key in the Param
+// query parameter or in Header, looked up with UserStore.UserByAPIKey().
+// The db backend needs AuthTables.APIKeyTable set for that.
+type APIKeyAuthenticator struct {
+	Users django.UserStore
+	// Param defaults to "api_key".
+	Param string
+	// Header is not read if empty.
+	Header string
+}
+
+// Authenticate returns the API key as the credentials.
+func (a *APIKeyAuthenticator) Authenticate(
+	ctx context.Context, r *http.Request,
+) (django.User, interface{}, error) {
+	param := a.Param
+	if param == "" {
+		param = "api_key"
+	}
+
+	key := r.URL.Query().Get(param)
+	if key == "" && a.Header != "" {
+		key = r.Header.Get(a.Header)
+	}
+	if key == "" {
+		return nil, nil, nil
+	}
+
+	user, err := activeUser(a.Users.UserByAPIKey(ctx, key))
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "invalid api key")
+	}
+	return user, key, nil
+}
+
+func (a *APIKeyAuthenticator) NeedsCSRF() bool {
+	return false
+}
+
+// activeUser checks the result of looking up a user by credentials, a missing
+// or inactive user means the credentials are invalid.
+func activeUser(user django.User, err error) (django.User, error) {
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Trace(django.ErrInvalidCredentials)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	v, _ := user.Field("is_active")
+	if active, ok := v.(bool); ok && !active {
+		return nil, errors.Annotate(
+			django.ErrInvalidCredentials, "user inactive or deleted",
+		)
+	}
+
+	return user, nil
+}
+
+// requestUser resolves the user of one request with the authenticators of
+// the service, the first time it is asked for.
+type requestUser struct {
+	r              *http.Request
+	authenticators []Authenticator
+
+	resolved bool
+	user     django.User
+	auth     interface{}
+	by       Authenticator
+	err      error
+}
+
+func ctx2RequestUser(ctx context.Context) *requestUser {
+	ru, _ := ctx.Value(KeyRequestUser).(*requestUser)
+	return ru
+}
+
+func (ru *requestUser) get(ctx context.Context) (django.User, error) {
+	if !ru.resolved {
+		ru.resolve(ctx)
+	}
+
+	if ru.err != nil {
+		return nil, ru.err
+	}
+	if ru.user == nil {
+		return nil, errors.Trace(django.ErrNoUser)
+	}
+	return ru.user, nil
+}
+
+func (ru *requestUser) resolve(ctx context.Context) {
+	ru.resolved = true
+
+	for _, a := range ru.authenticators {
+		user, auth, err := a.Authenticate(ctx, ru.r)
+		if err != nil {
+			amalgam.LOGGER.Debug("authentication_failed", "err", err)
+			ru.err = errors.Trace(err)
+			ru.by = a
+			return
+		}
+		if user != nil || auth != nil {
+			ru.user, ru.auth, ru.by = user, auth, a
+			return
+		}
+	}
+}
+
+// set records the outcome of Login() and Logout().
+func (ru *requestUser) set(user django.User, session django.Session) {
+	ru.resolved = true
+	ru.user = user
+	ru.auth = session
+	ru.by = &SessionAuthenticator{}
+	ru.err = nil
+}
+
+// needsCSRF reports if the request has to pass the CSRF check, which is the
+// case unless it was authenticated with credentials browsers do not send on
+// their own. Credentials that failed to authenticate do not count, as a
+// forged request can carry a made up api_key parameter.
+func (ru *requestUser) needsCSRF(ctx context.Context) bool {
+	if !ru.resolved {
+		ru.resolve(ctx)
+	}
+	return ru.err != nil || ru.by == nil || ru.by.NeedsCSRF()
+}
+
+// Ctx2User returns the user authenticated for the request, or an error wrapping
+// django.ErrNoUser if there is none.
+func Ctx2User(ctx context.Context) (django.User, error) {
+	ru := ctx2RequestUser(ctx)
+	if ru == nil {
+		return nil, errors.Trace(django.ErrNoUser)
+	}
+
+	user, err := ru.get(ctx)
+	return user, errors.Trace(err)
+}
+
+// Ctx2Auth returns what the user of the request authenticated with, like
+// request.auth of django rest framework: the django.Session, the token or API
+// key string, the claims of a JWT or an *OAuth2Token. It is nil for anonymous
+// requests.
+func Ctx2Auth(ctx context.Context) interface{} {
+	ru := ctx2RequestUser(ctx)
+	if ru == nil {
+		return nil
+	}
+
+	if _, err := ru.get(ctx); err != nil && ru.auth == nil {
+		return nil
+	}
+	return ru.auth
+}
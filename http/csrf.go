@@ -0,0 +1,440 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+var (
+	ErrNoCSRF = errors.New("no csrf in request")
+	// these are why a request failed the CSRF check, they match the reasons
+	// django gives.
+	ErrCSRFOrigin    = errors.New("origin checking failed")
+	ErrCSRFReferer   = errors.New("referer checking failed")
+	ErrCSRFNoCookie  = errors.New("CSRF cookie not set")
+	ErrCSRFMissing   = errors.New("CSRF token missing")
+	ErrCSRFIncorrect = errors.New("CSRF token incorrect")
+)
+
+const (
+	KeyRequestCSRF = "http-request-csrf"
+
+	// CSRFFormField is the form field django templates put the token in.
+	CSRFFormField = "csrfmiddlewaretoken"
+
+	csrfSecretLength = 32
+	csrfTokenLength  = 2 * csrfSecretLength
+	// csrfChars is django's CSRF_ALLOWED_CHARS, masking depends on the order.
+	csrfChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// requestCSRF tracks the CSRF secret of one request. The secret comes from the
+// csrftoken cookie, or from the session if amalgam.CSRFUseSessions is set, and
+// CodeWriter sends the cookie again if the secret was used or rotated.
+type requestCSRF struct {
+	cookie      string
+	loaded      bool
+	secret      string
+	needsUpdate bool
+}
+
+func ctx2RequestCSRF(ctx context.Context) *requestCSRF {
+	rc, _ := ctx.Value(KeyRequestCSRF).(*requestCSRF)
+	return rc
+}
+
+func (rc *requestCSRF) load(ctx context.Context) error {
+	if rc.loaded {
+		return nil
+	}
+
+	raw := rc.cookie
+	if amalgam.CSRFUseSessions {
+		raw = ""
+		if rs := ctx2RequestSession(ctx); rs != nil {
+			session, err := rs.get(ctx)
+			if err != nil && errors.Cause(err) != sql.ErrNoRows {
+				return errors.Trace(err)
+			}
+			raw, _ = session.GetString(django.KeyCSRFToken)
+		}
+	}
+
+	// a secret in the wrong format is replaced, like django does.
+	rc.secret, _ = tokenSecret(raw)
+	rc.loaded = true
+	return nil
+}
+
+// setSecret makes secret the CSRF secret of the request, in the session right
+// away if amalgam.CSRFUseSessions is set, otherwise in the cookie sent with the
+// response.
+func (rc *requestCSRF) setSecret(ctx context.Context, secret string) error {
+	rc.secret = secret
+	rc.loaded = true
+	rc.needsUpdate = true
+
+	if !amalgam.CSRFUseSessions {
+		return nil
+	}
+
+	rs := ctx2RequestSession(ctx)
+	if rs == nil {
+		return errors.Trace(ErrNoSession)
+	}
+
+	session, err := rs.get(ctx)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return errors.Trace(err)
+	}
+	rs.session = session
+
+	return errors.Trace(session.SetValue(ctx, django.KeyCSRFToken, secret))
+}
+
+// CSRFToken returns a token for the request to put in forms or in the
+// X-CSRFToken header, like django's get_token(). A new secret is created if
+// the client has none, and the CSRF cookie is sent with the response.
+func CSRFToken(ctx context.Context) (string, error) {
+	rc := ctx2RequestCSRF(ctx)
+	if rc == nil {
+		return "", errors.Trace(ErrNoCSRF)
+	}
+
+	if err := rc.load(ctx); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	secret := rc.secret
+	if secret == "" {
+		secret = amalgam.GetSecureRandomString(csrfSecretLength)
+	}
+	if err := rc.setSecret(ctx, secret); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return maskCSRFSecret(secret), nil
+}
+
+// RotateCSRFToken replaces the CSRF secret of the request, like django's
+// rotate_token(). Login() calls it so tokens from before the login stop
+// working.
+func RotateCSRFToken(ctx context.Context) error {
+	rc := ctx2RequestCSRF(ctx)
+	if rc == nil {
+		return errors.Trace(ErrNoCSRF)
+	}
+
+	secret := amalgam.GetSecureRandomString(csrfSecretLength)
+	return errors.Trace(rc.setSecret(ctx, secret))
+}
+
+// sendCSRFCookie sets the CSRF cookie if the secret was used or changed during
+// the request.
+func sendCSRFCookie(w http.ResponseWriter, rc *requestCSRF) {
+	if rc == nil || !rc.needsUpdate || amalgam.CSRFUseSessions {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     amalgam.CSRFCookieName,
+		Value:    rc.secret,
+		Path:     "/",
+		Domain:   amalgam.CSRFCookieDomain,
+		Secure:   amalgam.CSRFCookieSecure,
+		HttpOnly: amalgam.CSRFCookieHTTPOnly,
+		SameSite: sameSite(amalgam.CSRFCookieSameSite),
+		MaxAge:   amalgam.CSRFCookieAge,
+		Expires: time.Now().Add(
+			time.Duration(amalgam.CSRFCookieAge) * time.Second,
+		),
+	})
+	rc.needsUpdate = false
+}
+
+// CSRFExempt turns off the CSRF check for the handler registered for pattern,
+// like django's csrf_exempt decorator.
+func (s *shttp) CSRFExempt(pattern string) {
+	s.csrfExempt[pattern] = true
+}
+
+// csrfProtect wraps the handler registered for pattern so unsafe requests are
+// checked the way django's CsrfViewMiddleware checks them, anonymous ones
+// included. Requests authenticated with credentials browsers do not send on
+// their own, like an API key or token, need no CSRF token.
+func (s *shttp) csrfProtect(pattern string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if amalgam.UseCSRF && !s.csrfExempt[pattern] &&
+			!safeMethod(r.Method) && csrfRequired(r.Context()) {
+			if err := checkCSRF(r.Context(), r); err != nil {
+				amalgam.LOGGER.Warn(
+					"csrf_failed", "url", r.RequestURI, "err", err,
+				)
+				rejectCSRF(w, err)
+				return
+			}
+		}
+
+		fn(w, r)
+	}
+}
+
+func rejectCSRF(w http.ResponseWriter, err error) {
+	errMap := map[string][]amalgam.AError{}
+	errMap["__all__"] = append(
+		errMap["__all__"],
+		amalgam.AError{
+			Human: "CSRF verification failed", Code: "csrf_failed",
+			Context: errors.Cause(err).Error(),
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	j, _ := json.Marshal(&EResult{Errors: errMap, Success: false})
+	http.Error(w, string(j), http.StatusForbidden)
+}
+
+// csrfRequired is false only for requests authenticated with credentials
+// browsers do not send on their own.
+func csrfRequired(ctx context.Context) bool {
+	ru := ctx2RequestUser(ctx)
+	return ru == nil || ru.needsCSRF(ctx)
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func checkCSRF(ctx context.Context, r *http.Request) error {
+	rc := ctx2RequestCSRF(ctx)
+	if rc == nil {
+		return errors.Trace(ErrNoCSRF)
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !originVerified(r, origin) {
+			return errors.Annotatef(
+				ErrCSRFOrigin, "%s does not match any trusted origins", origin,
+			)
+		}
+	} else if isSecure(r) {
+		if err := checkReferer(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := rc.load(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if rc.secret == "" {
+		return errors.Trace(ErrCSRFNoCookie)
+	}
+
+	token := ""
+	if r.Method == http.MethodPost {
+		token = r.PostFormValue(CSRFFormField)
+	}
+	if token == "" {
+		token = r.Header.Get(amalgam.CSRFHeaderName)
+	}
+	if token == "" {
+		return errors.Trace(ErrCSRFMissing)
+	}
+
+	secret, ok := tokenSecret(token)
+	if !ok {
+		return errors.Annotate(ErrCSRFIncorrect, "token has the wrong format")
+	}
+	if !hmac.Equal([]byte(secret), []byte(rc.secret)) {
+		return errors.Trace(ErrCSRFIncorrect)
+	}
+
+	return nil
+}
+
+// isSecure is django's request.is_secure(). A header like X-Forwarded-Proto is
+// only trusted if amalgam.SecureProxySSLHeader names it, as clients can set it
+// themselves when there is no proxy.
+func isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	parts := strings.SplitN(amalgam.SecureProxySSLHeader, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	// like django only the first of several values is compared.
+	value := strings.SplitN(r.Header.Get(strings.TrimSpace(parts[0])), ",", 2)[0]
+	return strings.TrimSpace(value) == strings.TrimSpace(parts[1])
+}
+
+// trustedOrigins returns amalgam.CSRFTrustedOrigins split into scheme and
+// host, a host starting with "*" also matches its subdomains.
+func trustedOrigins() [][2]string {
+	var origins [][2]string
+	for _, origin := range strings.Split(amalgam.CSRFTrustedOrigins, ",") {
+		origin = strings.TrimSpace(origin)
+		idx := strings.Index(origin, "://")
+		if idx == -1 {
+			continue
+		}
+		origins = append(origins, [2]string{
+			strings.ToLower(origin[:idx]), strings.ToLower(origin[idx+3:]),
+		})
+	}
+	return origins
+}
+
+func originVerified(r *http.Request, origin string) bool {
+	scheme := "http"
+	if isSecure(r) {
+		scheme = "https"
+	}
+	if origin == scheme+"://"+r.Host {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+
+	for _, trusted := range trustedOrigins() {
+		if trusted[0] != strings.ToLower(u.Scheme) {
+			continue
+		}
+		if strings.HasPrefix(trusted[1], "*") {
+			if isSameDomain(host, trusted[1][1:]) {
+				return true
+			}
+		} else if host == trusted[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkReferer makes sure secure requests without an Origin header come from
+// a page of this site or a trusted origin.
+func checkReferer(r *http.Request) error {
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return errors.Annotate(ErrCSRFReferer, "no Referer")
+	}
+
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.Annotate(ErrCSRFReferer, "Referer is malformed")
+	}
+	if u.Scheme != "https" {
+		return errors.Annotate(
+			ErrCSRFReferer, "Referer is insecure while host is secure",
+		)
+	}
+
+	goodReferer := amalgam.CSRFCookieDomain
+	if amalgam.CSRFUseSessions {
+		goodReferer = amalgam.SessionCookieDomain
+	}
+	if goodReferer == "" {
+		goodReferer = r.Host
+	} else if _, port, err := net.SplitHostPort(r.Host); err == nil &&
+		port != "80" && port != "443" {
+		goodReferer += ":" + port
+	}
+
+	hosts := []string{strings.ToLower(goodReferer)}
+	for _, trusted := range trustedOrigins() {
+		hosts = append(hosts, strings.TrimPrefix(trusted[1], "*"))
+	}
+
+	host := strings.ToLower(u.Host)
+	for _, good := range hosts {
+		if isSameDomain(host, good) {
+			return nil
+		}
+	}
+
+	return errors.Annotatef(
+		ErrCSRFReferer, "%s does not match any trusted origins", referer,
+	)
+}
+
+// isSameDomain is django's is_same_domain(), a pattern starting with "."
+// matches the domain and all its subdomains.
+func isSameDomain(host, pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	if pattern[0] == '.' {
+		return strings.HasSuffix(host, pattern) || host == pattern[1:]
+	}
+	return host == pattern
+}
+
+// tokenSecret returns the secret of a masked token or of a bare secret, as
+// django accepts both.
+func tokenSecret(token string) (string, bool) {
+	for i := 0; i < len(token); i++ {
+		if strings.IndexByte(csrfChars, token[i]) == -1 {
+			return "", false
+		}
+	}
+
+	switch len(token) {
+	case csrfSecretLength:
+		return token, true
+	case csrfTokenLength:
+		return unmaskCSRFToken(token), true
+	}
+	return "", false
+}
+
+func maskCSRFSecret(secret string) string {
+	mask := amalgam.GetSecureRandomString(csrfSecretLength)
+
+	token := make([]byte, csrfTokenLength)
+	copy(token, mask)
+	for i := 0; i < csrfSecretLength; i++ {
+		idx := strings.IndexByte(csrfChars, secret[i]) +
+			strings.IndexByte(csrfChars, mask[i])
+		token[csrfSecretLength+i] = csrfChars[idx%len(csrfChars)]
+	}
+
+	return string(token)
+}
+
+func unmaskCSRFToken(token string) string {
+	mask, cipher := token[:csrfSecretLength], token[csrfSecretLength:]
+
+	secret := make([]byte, csrfSecretLength)
+	for i := 0; i < csrfSecretLength; i++ {
+		idx := strings.IndexByte(csrfChars, cipher[i]) -
+			strings.IndexByte(csrfChars, mask[i])
+		if idx < 0 {
+			idx += len(csrfChars)
+		}
+		secret[i] = csrfChars[idx]
+	}
+
+	return string(secret)
+}
@@ -0,0 +1,338 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// these come from django's csrf_tests, the masked tokens are what django's
+// get_token() hands out for testSecret.
+const (
+	testSecret        = "lcccccccX2kcccccccY2jcccccccssIC"
+	maskedTestSecret1 = "1bcdefghij2bcdefghij3bcdefghij4bcdefghij5bcdefghij6bcdefghijABCD"
+	maskedTestSecret2 = "2JgchWvM1tpxT2lfz9aydoXW9yT1DN3NdLiejYxOOlzzV4nhBbYqmqZYbAV3V5Bf"
+)
+
+func TestUnmaskDjangoTokens(t *testing.T) {
+	// django's test_unmask_cipher_token.
+	cases := []struct {
+		secret, token string
+	}{
+		{testSecret, maskedTestSecret1},
+		{testSecret, maskedTestSecret2},
+		{
+			strings.Repeat("a", 32),
+			"vFioG3XOLyGyGsPRFyB9iYUs341ufzIEvFioG3XOLyGyGsPRFyB9iYUs341ufzIE",
+		},
+		{strings.Repeat("a", 32), strings.Repeat("a", 64)},
+		{strings.Repeat("a", 32), strings.Repeat("b", 64)},
+		{strings.Repeat("b", 32), strings.Repeat("a", 32) + strings.Repeat("b", 32)},
+		{strings.Repeat("b", 32), strings.Repeat("b", 32) + strings.Repeat("c", 32)},
+		{strings.Repeat("c", 32), strings.Repeat("a", 32) + strings.Repeat("c", 32)},
+		// unmasked secrets are accepted as they are.
+		{testSecret, testSecret},
+	}
+
+	for _, c := range cases {
+		if secret, ok := tokenSecret(c.token); !ok || secret != c.secret {
+			t.Errorf("tokenSecret(%s) = %s, %v", c.token, secret, ok)
+		}
+	}
+
+	for _, token := range []string{
+		"", testSecret[:31], testSecret + "x", strings.Repeat("!", 32),
+	} {
+		if _, ok := tokenSecret(token); ok {
+			t.Errorf("tokenSecret(%q) accepted", token)
+		}
+	}
+}
+
+func TestMaskMatchesDjango(t *testing.T) {
+	// with the mask of a django token, masking gives that token back.
+	for _, token := range []string{maskedTestSecret1, maskedTestSecret2} {
+		mask := token[:csrfSecretLength]
+		cipher := make([]byte, csrfSecretLength)
+		for i := range cipher {
+			idx := strings.IndexByte(csrfChars, testSecret[i]) +
+				strings.IndexByte(csrfChars, mask[i])
+			cipher[i] = csrfChars[idx%len(csrfChars)]
+		}
+		if mask+string(cipher) != token {
+			t.Errorf("masked %s differently", token)
+		}
+	}
+
+	token := maskCSRFSecret(testSecret)
+	if secret, ok := tokenSecret(token); len(token) != csrfTokenLength ||
+		!ok || secret != testSecret {
+		t.Errorf("%s does not unmask to the secret", token)
+	}
+	if maskCSRFSecret(testSecret) == token {
+		t.Error("the same mask was used twice")
+	}
+}
+
+// withCSRFSettings restores the CSRF settings tests change.
+func withCSRFSettings(t *testing.T) {
+	trusted, proxy := amalgam.CSRFTrustedOrigins, amalgam.SecureProxySSLHeader
+	t.Cleanup(func() {
+		amalgam.CSRFTrustedOrigins, amalgam.SecureProxySSLHeader = trusted, proxy
+	})
+}
+
+// csrfRequest is a POST to example.com whose csrftoken cookie is cookie.
+func csrfRequest(
+	target, cookie string, headers map[string]string, form url.Values,
+) *http.Request {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(
+			http.MethodPost, target, strings.NewReader(form.Encode()),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(http.MethodPost, target, nil)
+	}
+	r.Host = "example.com"
+	if strings.HasPrefix(target, "https:") {
+		r.TLS = &tls.ConnectionState{}
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	ctx := context.WithValue(
+		r.Context(), KeyRequestCSRF, &requestCSRF{cookie: cookie},
+	)
+	return r.WithContext(ctx)
+}
+
+func TestCheckCSRFToken(t *testing.T) {
+	withCSRFSettings(t)
+
+	cases := []struct {
+		name    string
+		cookie  string
+		headers map[string]string
+		form    url.Values
+		err     error
+	}{
+		{
+			"django token in header", testSecret,
+			map[string]string{"X-CSRFToken": maskedTestSecret2}, nil, nil,
+		},
+		{
+			"django token in form", testSecret, nil,
+			url.Values{CSRFFormField: {maskedTestSecret1}}, nil,
+		},
+		{
+			// django before 4.1 kept a masked token in the cookie.
+			"masked cookie", maskedTestSecret1,
+			map[string]string{"X-CSRFToken": maskedTestSecret2}, nil, nil,
+		},
+		{
+			"unmasked token", testSecret,
+			map[string]string{"X-CSRFToken": testSecret}, nil, nil,
+		},
+		{
+			"no cookie", "",
+			map[string]string{"X-CSRFToken": maskedTestSecret2}, nil,
+			ErrCSRFNoCookie,
+		},
+		{"no token", testSecret, nil, nil, ErrCSRFMissing},
+		{
+			"wrong token", testSecret,
+			map[string]string{"X-CSRFToken": strings.Repeat("a", 64)}, nil,
+			ErrCSRFIncorrect,
+		},
+		{
+			"malformed token", testSecret,
+			map[string]string{"X-CSRFToken": maskedTestSecret2[:63] + "!"}, nil,
+			ErrCSRFIncorrect,
+		},
+	}
+
+	for _, c := range cases {
+		r := csrfRequest("http://example.com/", c.cookie, c.headers, c.form)
+		err := checkCSRF(r.Context(), r)
+		if errors.Cause(err) != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestCheckCSRFOriginAndReferer(t *testing.T) {
+	withCSRFSettings(t)
+
+	cases := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		trusted string
+		proxy   string
+		err     error
+	}{
+		{
+			"same origin", "http://example.com/",
+			map[string]string{"Origin": "http://example.com"}, "", "", nil,
+		},
+		{
+			"other origin", "http://example.com/",
+			map[string]string{"Origin": "http://evil.com"}, "", "",
+			ErrCSRFOrigin,
+		},
+		{
+			"insecure origin for a secure request", "https://example.com/",
+			map[string]string{"Origin": "http://example.com"}, "", "",
+			ErrCSRFOrigin,
+		},
+		{
+			"trusted subdomain", "https://example.com/",
+			map[string]string{"Origin": "https://app.example.com"},
+			"https://*.example.com", "", nil,
+		},
+		{
+			"trusted origin with another scheme", "https://example.com/",
+			map[string]string{"Origin": "http://app.example.com"},
+			"https://*.example.com", "", ErrCSRFOrigin,
+		},
+		{
+			"no referer over http", "http://example.com/", nil, "", "", nil,
+		},
+		{
+			"no referer over https", "https://example.com/", nil, "", "",
+			ErrCSRFReferer,
+		},
+		{
+			"same site referer", "https://example.com/",
+			map[string]string{"Referer": "https://example.com/login/"}, "", "",
+			nil,
+		},
+		{
+			"insecure referer", "https://example.com/",
+			map[string]string{"Referer": "http://example.com/login/"}, "", "",
+			ErrCSRFReferer,
+		},
+		{
+			"other referer", "https://example.com/",
+			map[string]string{"Referer": "https://evil.com/"}, "", "",
+			ErrCSRFReferer,
+		},
+		{
+			"trusted referer", "https://example.com/",
+			map[string]string{"Referer": "https://app.example.com/"},
+			"https://*.example.com", "", nil,
+		},
+		{
+			// without SECURE_PROXY_SSL_HEADER the header is the client's.
+			"forwarded proto not trusted", "http://example.com/",
+			map[string]string{"X-Forwarded-Proto": "https"}, "", "", nil,
+		},
+		{
+			"forwarded proto trusted", "http://example.com/",
+			map[string]string{"X-Forwarded-Proto": "https"}, "",
+			"X-Forwarded-Proto: https", ErrCSRFReferer,
+		},
+		{
+			"forwarded proto trusted, secure origin", "http://example.com/",
+			map[string]string{
+				"X-Forwarded-Proto": "https", "Origin": "https://example.com",
+			},
+			"", "X-Forwarded-Proto: https", nil,
+		},
+		{
+			"forwarded proto is http", "http://example.com/",
+			map[string]string{"X-Forwarded-Proto": "http"}, "",
+			"X-Forwarded-Proto: https", nil,
+		},
+	}
+
+	for _, c := range cases {
+		amalgam.CSRFTrustedOrigins = c.trusted
+		amalgam.SecureProxySSLHeader = c.proxy
+
+		headers := map[string]string{"X-CSRFToken": maskedTestSecret2}
+		for k, v := range c.headers {
+			headers[k] = v
+		}
+
+		r := csrfRequest(c.target, testSecret, headers, nil)
+		err := checkCSRF(r.Context(), r)
+		if errors.Cause(err) != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+// credentialsAuthenticator authenticates requests with an X-Key header, like
+// an API key, or fails if it is "bad".
+type credentialsAuthenticator struct{}
+
+func (credentialsAuthenticator) Authenticate(
+	_ context.Context, r *http.Request,
+) (django.User, interface{}, error) {
+	switch key := r.Header.Get("X-Key"); key {
+	case "":
+		return nil, nil, nil
+	case "bad":
+		return nil, nil, errors.Trace(django.ErrInvalidCredentials)
+	default:
+		return nil, key, nil
+	}
+}
+
+func (credentialsAuthenticator) NeedsCSRF() bool {
+	return false
+}
+
+func TestCSRFProtect(t *testing.T) {
+	withCSRFSettings(t)
+
+	s := &shttp{csrfExempt: map[string]bool{"/hook/": true}}
+	cases := []struct {
+		name    string
+		pattern string
+		method  string
+		key     string
+		token   string
+		code    int
+	}{
+		{"anonymous", "/login/", http.MethodPost, "", "", 403},
+		{"anonymous with token", "/login/", http.MethodPost, "", maskedTestSecret2, 200},
+		{"safe method", "/login/", http.MethodGet, "", "", 200},
+		{"api key", "/api/", http.MethodPost, "secret", "", 200},
+		{"bad api key", "/api/", http.MethodPost, "bad", "", 403},
+		{"exempt", "/hook/", http.MethodPost, "", "", 200},
+	}
+
+	for _, c := range cases {
+		r := csrfRequest("http://example.com"+c.pattern, testSecret, nil, nil)
+		r.Method = c.method
+		if c.key != "" {
+			r.Header.Set("X-Key", c.key)
+		}
+		if c.token != "" {
+			r.Header.Set("X-CSRFToken", c.token)
+		}
+		ru := &requestUser{
+			r: r, authenticators: []Authenticator{credentialsAuthenticator{}},
+		}
+		r = r.WithContext(context.WithValue(r.Context(), KeyRequestUser, ru))
+
+		w := httptest.NewRecorder()
+		s.csrfProtect(c.pattern, func(http.ResponseWriter, *http.Request) {})(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: got %d, want %d", c.name, w.Code, c.code)
+		}
+	}
+}
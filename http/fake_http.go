@@ -6,6 +6,8 @@ import (
 
 	"github.com/amitu/amalgam"
 	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/axes"
+	"github.com/amitu/amalgam/django/otp"
 )
 
 type fhttp struct {
@@ -23,6 +25,10 @@ func (f *fhttp) Register(pattern string, fn http.HandlerFunc) {
 	panic("not implemented")
 }
 
+func (f *fhttp) CSRFExempt(pattern string) {
+	panic("not implemented")
+}
+
 func (f *fhttp) Redirect(w http.ResponseWriter, r *http.Request, url string, code int) {
 	panic("not implemented")
 }
@@ -40,6 +46,46 @@ func (f *fhttp) GetUser(ctx context.Context) (django.User, error) {
 	return nil, nil
 }
 
+func (f *fhttp) LoginRequired(fn http.HandlerFunc) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) PermissionRequired(
+	fn http.HandlerFunc, perms ...string,
+) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) RoleRequired(
+	fn http.HandlerFunc, roles ...int64,
+) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) UserPassesTest(fn http.HandlerFunc, test UserTest) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) OTPRequired(fn http.HandlerFunc, devices otp.Store) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) RequireScopes(
+	fn http.HandlerFunc, scopes ...string,
+) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) LockoutProtected(
+	fn http.HandlerFunc, attempts axes.Store,
+) http.HandlerFunc {
+	panic("not implemented")
+}
+
+func (f *fhttp) RejectLockedOut(w http.ResponseWriter) {
+	panic("not implemented")
+}
+
 func (f *fhttp) GetOrCreateTracker(
 	ctx context.Context, r *http.Request,
 ) (string, error) {
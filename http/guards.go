@@ -0,0 +1,156 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/otp"
+	"github.com/juju/errors"
+)
+
+// UserTest decides if user may use a handler wrapped by UserPassesTest.
+type UserTest func(ctx context.Context, user django.User) (bool, error)
+
+// UserPassesTest is django's user_passes_test, fn is only called if a user is
+// logged in and passes test. Otherwise browsers are redirected to
+// amalgam.LoginURL and other clients get a rejection.
+func (s *shttp) UserPassesTest(fn http.HandlerFunc, test UserTest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		user, err := s.GetUser(ctx)
+		if err != nil {
+			switch errors.Cause(err) {
+			case django.ErrNoUser, sql.ErrNoRows:
+				s.denyAccess(w, r, "login_required", "Login required")
+			case django.ErrInvalidCredentials:
+				s.denyAccess(
+					w, r, "invalid_credentials", "Invalid credentials",
+				)
+			default:
+				s.rejectGuard(w, "user_check_failed", err)
+			}
+			return
+		}
+
+		ok, err := test(ctx, user)
+		if err != nil {
+			s.rejectGuard(w, "user_test_failed", err)
+			return
+		}
+		if !ok {
+			s.denyAccess(w, r, "permission_denied", "Permission denied")
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// LoginRequired is django's login_required, fn is only called if a user is
+// logged in.
+func (s *shttp) LoginRequired(fn http.HandlerFunc) http.HandlerFunc {
+	return s.UserPassesTest(fn, func(context.Context, django.User) (bool, error) {
+		return true, nil
+	})
+}
+
+// PermissionRequired is django's permission_required, fn is only called if
+// the user has all of perms, given as "app_label.codename".
+func (s *shttp) PermissionRequired(
+	fn http.HandlerFunc, perms ...string,
+) http.HandlerFunc {
+	return s.UserPassesTest(fn, func(_ context.Context, user django.User) (bool, error) {
+		for _, perm := range perms {
+			ok, err := user.HasPermission(perm)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// RoleRequired only calls fn if the user is in at least one of the groups with
+// the ids in roles.
+func (s *shttp) RoleRequired(fn http.HandlerFunc, roles ...int64) http.HandlerFunc {
+	return s.UserPassesTest(fn, func(ctx context.Context, user django.User) (bool, error) {
+		for _, role := range roles {
+			ok, err := user.HasRole(ctx, role)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// OTPRequired is django-otp's otp_required, fn is only called if the user
+// verified the session with one of their devices in devices.
+func (s *shttp) OTPRequired(fn http.HandlerFunc, devices otp.Store) http.HandlerFunc {
+	return s.UserPassesTest(fn, func(ctx context.Context, user django.User) (bool, error) {
+		session, err := s.GetSession(ctx)
+		if err != nil {
+			if errors.Cause(err) == sql.ErrNoRows {
+				return false, nil
+			}
+			return false, errors.Trace(err)
+		}
+
+		ok, err := devices.IsVerified(ctx, session, user)
+		return ok, errors.Trace(err)
+	})
+}
+
+func (s *shttp) rejectGuard(w http.ResponseWriter, event string, err error) {
+	amalgam.LOGGER.Error(event, "err", errors.ErrorStack(err))
+
+	errMap := map[string][]amalgam.AError{}
+	errMap["__all__"] = append(
+		errMap["__all__"],
+		amalgam.AError{Human: "Oops something went wrong"},
+	)
+	s.Reject(w, errMap)
+}
+
+// denyAccess redirects browsers to the login page, like django does, and
+// rejects everyone else.
+func (s *shttp) denyAccess(
+	w http.ResponseWriter, r *http.Request, code, human string,
+) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		s.Redirect(w, r, loginURL(r), http.StatusFound)
+		return
+	}
+
+	errMap := map[string][]amalgam.AError{}
+	errMap["__all__"] = append(
+		errMap["__all__"], amalgam.AError{Human: human, Code: code},
+	)
+	s.Reject(w, errMap)
+}
+
+// loginURL returns amalgam.LoginURL with the current path in "next", like
+// django's redirect_to_login().
+func loginURL(r *http.Request) string {
+	u, err := url.Parse(amalgam.LoginURL)
+	if err != nil {
+		return amalgam.LoginURL
+	}
+
+	q := u.Query()
+	q.Set("next", r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,358 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+var (
+	ErrBadJWTKey = errors.New("bad jwt key")
+)
+
+// JWTAuthenticator is djangorestframework-simplejwt's JWTAuthentication, it
+// reads "Authorization: Bearer <token>" headers carrying access tokens issued
+// by simplejwt. The zero value plus Users matches simplejwt's defaults.
+type JWTAuthenticator struct {
+	Users django.UserStore
+	// Algorithm is simplejwt's ALGORITHM, one of HS256 (the default), HS384,
+	// HS512, RS256, RS384 and RS512. Tokens signed with any other algorithm
+	// are rejected.
+	Algorithm string
+	// SigningKey verifies HS* tokens, it defaults to amalgam.Secret.
+	SigningKey string
+	// VerifyingKeys verify RS* tokens, a token signed with any of them is
+	// accepted so keys can be rotated. See ParseRSAPublicKey().
+	VerifyingKeys []*rsa.PublicKey
+	// HeaderTypes is AUTH_HEADER_TYPES, defaults to "Bearer".
+	HeaderTypes []string
+	// UserIDClaim is USER_ID_CLAIM, defaults to "user_id".
+	UserIDClaim string
+	// TokenType is the token_type claim of access tokens, defaults to
+	// "access".
+	TokenType string
+	// Audience and Issuer are checked if not empty.
+	Audience string
+	Issuer   string
+	// Leeway is allowed when checking exp and nbf.
+	Leeway time.Duration
+	// CheckBlacklist rejects tokens whose jti is in simplejwt's token
+	// blacklist. simplejwt only blacklists refresh tokens, so this is needed
+	// only if access tokens get blacklisted as well.
+	CheckBlacklist bool
+	// OutstandingTable and BlacklistedTable default to the tables of
+	// rest_framework_simplejwt.token_blacklist.
+	OutstandingTable string
+	BlacklistedTable string
+}
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key, like simplejwt's
+// VERIFYING_KEY.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Annotate(ErrBadJWTKey, "no pem block found")
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.Annotate(ErrBadJWTKey, "not an rsa key")
+		}
+		return rsaKey, nil
+	}
+
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Annotate(ErrBadJWTKey, err.Error())
+	}
+	return key, nil
+}
+
+// Authenticate returns the claims of the token as the credentials. Bearer
+// tokens that are not JWTs are left to the next authenticator, so OAuth2
+// tokens can be accepted as well.
+func (a *JWTAuthenticator) Authenticate(
+	ctx context.Context, r *http.Request,
+) (django.User, interface{}, error) {
+	headerTypes := a.HeaderTypes
+	if len(headerTypes) == 0 {
+		headerTypes = []string{"Bearer"}
+	}
+
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) == 0 || !containsString(headerTypes, parts[0]) {
+		return nil, nil, nil
+	}
+	if len(parts) != 2 {
+		return nil, nil, errors.Annotate(
+			django.ErrInvalidCredentials,
+			"authorization header must contain two space-delimited values",
+		)
+	}
+	if strings.Count(parts[1], ".") != 2 {
+		return nil, nil, nil
+	}
+
+	claims, err := a.verify(parts[1])
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if a.CheckBlacklist {
+		if err := a.checkBlacklist(ctx, claims); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	userIDClaim := a.UserIDClaim
+	if userIDClaim == "" {
+		userIDClaim = "user_id"
+	}
+	uid, err := claimInt64(claims[userIDClaim])
+	if err != nil {
+		return nil, nil, errors.Annotate(
+			django.ErrInvalidCredentials,
+			"token contained no recognizable user identification",
+		)
+	}
+
+	user, err := activeUser(a.Users.UserByID(ctx, uid))
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "user not found")
+	}
+	return user, claims, nil
+}
+
+func (a *JWTAuthenticator) NeedsCSRF() bool {
+	return false
+}
+
+func (a *JWTAuthenticator) algorithm() string {
+	if a.Algorithm == "" {
+		return "HS256"
+	}
+	return a.Algorithm
+}
+
+// verify checks the signature and the registered claims of token and returns
+// its claims.
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	invalid := func(reason string) error {
+		return errors.Annotate(django.ErrInvalidCredentials, reason)
+	}
+
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, invalid("token is malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(segments[0], &header); err != nil {
+		return nil, invalid("token header is malformed")
+	}
+	if header.Alg != a.algorithm() {
+		return nil, invalid("token is signed with " + header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, invalid("token signature is malformed")
+	}
+	ok, err := a.checkSignature(segments[0]+"."+segments[1], sig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !ok {
+		return nil, invalid("token signature is invalid")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTSegment(segments[1], &claims); err != nil {
+		return nil, invalid("token payload is malformed")
+	}
+
+	now := time.Now()
+	exp, err := claimInt64(claims["exp"])
+	if err != nil {
+		return nil, invalid("token has no exp claim")
+	}
+	if now.After(time.Unix(exp, 0).Add(a.Leeway)) {
+		return nil, invalid("token is expired")
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, err := claimInt64(v)
+		if err != nil || now.Before(time.Unix(nbf, 0).Add(-a.Leeway)) {
+			return nil, invalid("token is not yet valid")
+		}
+	}
+
+	tokenType := a.TokenType
+	if tokenType == "" {
+		tokenType = "access"
+	}
+	if claims["token_type"] != tokenType {
+		return nil, invalid("token has wrong type")
+	}
+
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, invalid("token has wrong issuer")
+	}
+	if a.Audience != "" && !audienceMatches(claims["aud"], a.Audience) {
+		return nil, invalid("token has wrong audience")
+	}
+
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) checkSignature(signed string, sig []byte) (bool, error) {
+	alg := a.algorithm()
+	if len(alg) != 5 {
+		return false, errors.Annotate(ErrBadJWTKey, "unknown algorithm "+alg)
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return false, errors.Annotate(ErrBadJWTKey, "unknown algorithm "+alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		key := a.SigningKey
+		if key == "" {
+			key = amalgam.Secret
+		}
+		mac := hmac.New(newHash, []byte(key))
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil)), nil
+	case "RS":
+		if len(a.VerifyingKeys) == 0 {
+			return false, errors.Annotate(ErrBadJWTKey, "no verifying keys")
+		}
+		h := newHash()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		for _, key := range a.VerifyingKeys {
+			if rsa.VerifyPKCS1v15(key, cryptoHash, digest, sig) == nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, errors.Annotate(ErrBadJWTKey, "unknown algorithm "+alg)
+}
+
+func (a *JWTAuthenticator) checkBlacklist(
+	ctx context.Context, claims map[string]interface{},
+) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return errors.Annotate(django.ErrInvalidCredentials, "token has no jti")
+	}
+
+	outstanding := a.OutstandingTable
+	if outstanding == "" {
+		outstanding = "token_blacklist_outstandingtoken"
+	}
+	blacklisted := a.BlacklistedTable
+	if blacklisted == "" {
+		blacklisted = "token_blacklist_blacklistedtoken"
+	}
+
+	query := fmt.Sprintf(
+		"SELECT count(*) FROM %s b JOIN %s o ON o.id = b.token_id "+
+			"WHERE o.jti = $1",
+		blacklisted, outstanding,
+	)
+	count, err := amalgam.QueryIntoInt(ctx, query, jti)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if count != 0 {
+		return errors.Annotate(
+			django.ErrInvalidCredentials, "token is blacklisted",
+		)
+	}
+
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return errors.Trace(dec.Decode(v))
+}
+
+// claimInt64 accepts numbers and numeric strings, simplejwt stores user ids
+// that are not integers as strings.
+func claimInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		return int64(f), errors.Trace(err)
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, errors.Trace(err)
+	}
+	return 0, errors.Errorf("claim %v is not a number", v)
+}
+
+func audienceMatches(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
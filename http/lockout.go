@@ -0,0 +1,42 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django/axes"
+)
+
+// LockoutProtected wraps login handlers, fn is not called for requests that
+// django-axes would lock out. The username is read from the form field
+// configured in attempts.
+func (s *shttp) LockoutProtected(fn http.HandlerFunc, attempts axes.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locked, err := attempts.IsRequestLocked(r.Context(), r)
+		if err != nil {
+			s.rejectGuard(w, "lockout_check_failed", err)
+			return
+		}
+		if locked {
+			s.RejectLockedOut(w)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// RejectLockedOut rejects the request with the message of django-axes, for
+// handlers that get axes.ErrLockedOut.
+func (s *shttp) RejectLockedOut(w http.ResponseWriter) {
+	errMap := map[string][]amalgam.AError{}
+	errMap["__all__"] = append(
+		errMap["__all__"],
+		amalgam.AError{
+			Human: "Account locked: too many login attempts. " +
+				"Please try again later.",
+			Code: "locked_out",
+		},
+	)
+	s.Reject(w, errMap)
+}
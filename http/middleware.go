@@ -23,7 +23,115 @@ var (
 	ErrSessionItemIsNotString = errors.New("session item is not string")
 )
 
+const (
+	KeyRequestSession = "http-request-session"
+)
+
+// requestSession tracks the session of one request. The session is loaded, or
+// created if the client sent no cookie, when a handler first asks for it, and
+// handlers share it afterwards. CodeWriter sends a new session cookie if the
+// session key no longer matches the cookie the client sent, which happens when
+// a new session is first written to, its key is cycled, or with signed cookie
+// sessions.
+type requestSession struct {
+	cookie  string
+	session django.Session
+	store   django.SessionStore
+}
+
+func ctx2RequestSession(ctx context.Context) *requestSession {
+	rs, _ := ctx.Value(KeyRequestSession).(*requestSession)
+	return rs
+}
+
+// get returns the session of the request, loading it the first time. Like
+// SessionStore.GetSessionBySessionKey() it returns a usable session along with
+// sql.ErrNoRows if the session does not exist.
+func (rs *requestSession) get(ctx context.Context) (django.Session, error) {
+	if rs.session != nil {
+		return rs.session, nil
+	}
+
+	if rs.cookie == "" {
+		session, err := rs.store.CreateSession(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rs.session = session
+		return session, nil
+	}
+
+	session, err := rs.store.GetSessionBySessionKey(ctx, rs.cookie)
+	if err != nil {
+		return session, errors.Trace(err)
+	}
+
+	rs.session = session
+	return session, nil
+}
+
+// sendSessionCookie sets the session cookie if the session key changed during
+// the request, or deletes it if the session was destroyed. Like django it is
+// sent every time with amalgam.SessionSaveEveryRequest, as the expiry of the
+// session moved.
+func sendSessionCookie(w http.ResponseWriter, rs *requestSession) {
+	if rs == nil || rs.session == nil {
+		return
+	}
+
+	key := rs.session.SessionKey()
+	if key == rs.cookie && (key == "" || !amalgam.SessionSaveEveryRequest) {
+		return
+	}
+
+	http.SetCookie(w, sessionCookie(key))
+	rs.cookie = key
+}
+
+// sessionCookie returns the session cookie for key, or a cookie deleting the
+// session cookie if key is empty, with the attributes django would set.
+func sessionCookie(key string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     amalgam.SessionCookieName,
+		Value:    key,
+		Path:     "/",
+		Domain:   amalgam.SessionCookieDomain,
+		Secure:   amalgam.SessionCookieSecure,
+		HttpOnly: amalgam.SessionCookieHTTPOnly,
+		SameSite: sameSite(amalgam.SessionCookieSameSite),
+	}
+
+	switch {
+	case key == "":
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	case !amalgam.SessionExpireAtBrowserClose:
+		cookie.MaxAge = amalgam.SessionCookieAge
+		cookie.Expires = time.Now().Add(
+			time.Duration(amalgam.SessionCookieAge) * time.Second,
+		)
+	}
+
+	return cookie
+}
+
+func sameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
 func (s *shttp) GetSession(ctx context.Context) (django.Session, error) {
+	if rs := ctx2RequestSession(ctx); rs != nil {
+		return rs.get(ctx)
+	}
+
 	sessionid, err := amalgam.Ctx2SessionKey(ctx)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -40,7 +148,15 @@ func (s *shttp) SetSession(
 		return errors.Trace(err)
 	}
 
-	return errors.Trace(session.SetValue(ctx, key, value))
+	err = session.SetValue(ctx, key, value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if rs := ctx2RequestSession(ctx); rs != nil {
+		rs.session = session
+	}
+	return nil
 }
 
 func (s *shttp) GetSessionString(ctx context.Context, key string) (string, error) {
@@ -61,7 +177,16 @@ func (s *shttp) GetSessionInt64(ctx context.Context, key string) (int64, error)
 	return session.GetInt64(key)
 }
 
+// GetUser returns the user found by the authenticators of the service, see
+// HTTPOptions. It returns an error wrapping django.ErrNoUser if nobody is
+// logged in and one wrapping django.ErrInvalidCredentials if the request
+// carries wrong credentials.
 func (s *shttp) GetUser(ctx context.Context) (django.User, error) {
+	if ru := ctx2RequestUser(ctx); ru != nil {
+		user, err := ru.get(ctx)
+		return user, errors.Trace(err)
+	}
+
 	session, err := s.GetSession(ctx)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -80,9 +205,21 @@ type CodeWriter struct {
 	code     int
 	hasError bool
 	http.ResponseWriter
+
+	session     *requestSession
+	csrf        *requestCSRF
+	commitHooks *amalgam.CommitHooks
+	wroteHeader bool
 }
 
 func (c *CodeWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	sendSessionCookie(c.ResponseWriter, c.session)
+	sendCSRFCookie(c.ResponseWriter, c.csrf)
+
 	if code > 399 {
 		err := c.Tx.Rollback()
 		if err != nil {
@@ -104,6 +241,8 @@ func (c *CodeWriter) WriteHeader(code int) {
 					"err", errors.ErrorStack(err),
 				)
 			}
+		} else if c.commitHooks != nil {
+			c.commitHooks.Run()
 		}
 	}
 	c.code = 200
@@ -111,6 +250,10 @@ func (c *CodeWriter) WriteHeader(code int) {
 }
 
 func (c *CodeWriter) Write(resp []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
 	if c.hasError {
 		errMap := map[string][]amalgam.AError{}
 		errMap["__all__"] = append(
@@ -150,8 +293,11 @@ func (s *shttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	ctx := context.WithValue(r.Context(), amalgam.KeyDBTransaction, tx)
 	ctx = context.WithValue(ctx, amalgam.KeyDB, db)
+	ctx, hooks := amalgam.WithCommitHooks(ctx)
 
-	w2 := &CodeWriter{tx, 200, false, w}
+	w2 := &CodeWriter{
+		Tx: tx, code: 200, ResponseWriter: w, commitHooks: hooks,
+	}
 
 	start := time.Now()
 	logger := amalgam.LOGGER.New(
@@ -215,36 +361,41 @@ func (s *shttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 
-	errMap := map[string][]amalgam.AError{}
-
 	if amalgam.UseSession {
-		sessionid, err := r.Cookie("sessionid")
-		if err != nil {
-			if err == http.ErrNoCookie {
-				sid, err := s.sessions.CreateSession(ctx)
-				if err != nil {
-					logger.Crit(
-						"session_creation_error",
-						"err",
-						errors.ErrorStack(errors.Trace(err)),
-					)
-					errMap["__all__"] = append(
-						errMap["__all__"],
-						amalgam.AError{Human: "Oops something went wrong"},
-					)
-					s.Reject(w, errMap)
-					return
-				}
-
-				sessionid = &http.Cookie{
-					Name: "sessionid", Value: sid.SessionKey(), Path: "/",
-				}
-				http.SetCookie(w, sessionid)
+		rs := &requestSession{store: s.sessions}
+		if sessionid, err := r.Cookie(amalgam.SessionCookieName); err == nil {
+			rs.cookie = sessionid.Value
+		}
+
+		// no session is created here, see requestSession.
+		ctx = context.WithValue(ctx, amalgam.KeySession, rs.cookie)
+		ctx = context.WithValue(ctx, KeyRequestSession, rs)
+		w2.session = rs
+
+		rc := &requestCSRF{}
+		if csrftoken, err := r.Cookie(amalgam.CSRFCookieName); err == nil {
+			rc.cookie = csrftoken.Value
+		}
+		ctx = context.WithValue(ctx, KeyRequestCSRF, rc)
+		w2.csrf = rc
+
+		// django saves the session of every request with
+		// SESSION_SAVE_EVERY_REQUEST, used or not, which loading it does.
+		if amalgam.SessionSaveEveryRequest && rs.cookie != "" {
+			_, err := rs.get(ctx)
+			if err != nil && errors.Cause(err) != sql.ErrNoRows {
+				logger.Error("session_load_failed", "err", errors.ErrorStack(err))
 			}
 		}
 
-		ctx = context.WithValue(ctx, amalgam.KeySession, sessionid.Value)
+		ru := &requestUser{r: r, authenticators: s.options.Authenticators}
+		ctx = context.WithValue(ctx, KeyRequestUser, ru)
+		ctx = context.WithValue(ctx, django.KeyActor, django.ActorFunc(Ctx2User))
+
 		s.mux.ServeHTTP(w2, r.WithContext(ctx))
+		if !w2.wroteHeader {
+			w2.WriteHeader(http.StatusOK)
+		}
 
 		logger.Debug("http_served")
 	}
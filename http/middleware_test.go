@@ -0,0 +1,127 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/inconshreveable/log15"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+func init() {
+	amalgam.LOGGER = log15.New()
+	amalgam.LOGGER.SetHandler(log15.DiscardHandler())
+}
+
+// testTx returns a context with a transaction that is rolled back after the
+// test, after running schema in it. Tests using it need postgres, they are
+// skipped unless AMALGAM_TEST_DSN has a lib/pq connection string.
+func testTx(t *testing.T, schema ...string) context.Context {
+	dsn := os.Getenv("AMALGAM_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AMALGAM_TEST_DSN not set")
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+		db.Close()
+	})
+
+	for _, query := range schema {
+		if _, err := tx.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), amalgam.KeyDBTransaction, tx)
+	return context.WithValue(ctx, amalgam.KeyDB, db)
+}
+
+// fakeUser is a django.User with just an id and fields.
+type fakeUser struct {
+	django.User
+	id     int64
+	fields map[string]interface{}
+}
+
+func (u *fakeUser) ID() int64 { return u.id }
+
+func (u *fakeUser) Field(name string) (interface{}, bool) {
+	v, ok := u.fields[name]
+	return v, ok
+}
+
+// fakeUsers is a django.UserStore that only finds users by id.
+type fakeUsers struct {
+	django.UserStore
+	users map[int64]*fakeUser
+}
+
+func (s *fakeUsers) UserByID(_ context.Context, id int64) (django.User, error) {
+	u, ok := s.users[id]
+	if !ok {
+		return nil, errors.Trace(sql.ErrNoRows)
+	}
+	return u, nil
+}
+
+func newFakeUsers() *fakeUsers {
+	return &fakeUsers{users: map[int64]*fakeUser{
+		42: {id: 42},
+		43: {id: 43, fields: map[string]interface{}{"is_active": false}},
+	}}
+}
+
+func TestSessionCookieSentEveryRequest(t *testing.T) {
+	defer func(v bool) { amalgam.SessionSaveEveryRequest = v }(
+		amalgam.SessionSaveEveryRequest,
+	)
+
+	session, err := django.NewFakeSessionStore().CreateSession(
+		context.Background(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := session.SessionKey()
+
+	cases := []struct {
+		saveEveryRequest bool
+		cookie           string
+		sent             bool
+	}{
+		{false, key, false},
+		{false, "old", true},
+		{true, key, true},
+	}
+
+	for _, c := range cases {
+		amalgam.SessionSaveEveryRequest = c.saveEveryRequest
+		w := httptest.NewRecorder()
+		sendSessionCookie(w, &requestSession{cookie: c.cookie, session: session})
+
+		header := w.Header().Get("Set-Cookie")
+		if sent := header != ""; sent != c.sent {
+			t.Errorf("%+v: Set-Cookie = %q", c, header)
+		}
+		if c.sent && !strings.Contains(header, "Max-Age=1209600") {
+			t.Errorf("%+v: no Max-Age in %q", c, header)
+		}
+	}
+}
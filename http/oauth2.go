@@ -0,0 +1,177 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amitu/amalgam"
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// OAuth2Token is an access token issued by django-oauth-toolkit, Ctx2Auth()
+// returns it for requests authenticated by OAuth2Authenticator.
+type OAuth2Token struct {
+	ID      int64     `db:"id"`
+	Scope   string    `db:"scope"`
+	Expires time.Time `db:"expires"`
+	// UserID is not valid for client credentials tokens.
+	UserID          sql.NullInt64  `db:"user_id"`
+	ApplicationID   sql.NullInt64  `db:"application_id"`
+	ClientID        sql.NullString `db:"client_id"`
+	ApplicationName sql.NullString `db:"application_name"`
+}
+
+// Scopes returns the space separated scopes of the token.
+func (t *OAuth2Token) Scopes() []string {
+	return strings.Fields(t.Scope)
+}
+
+// HasScopes returns true if the token has all of scopes.
+func (t *OAuth2Token) HasScopes(scopes ...string) bool {
+	have := t.Scopes()
+	for _, scope := range scopes {
+		if !containsString(have, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ctx2OAuth2Token returns the token the request was authenticated with by
+// OAuth2Authenticator, or false if it was not.
+func Ctx2OAuth2Token(ctx context.Context) (*OAuth2Token, bool) {
+	token, ok := Ctx2Auth(ctx).(*OAuth2Token)
+	return token, ok
+}
+
+// OAuth2Authenticator is django-oauth-toolkit's OAuth2Authentication, it reads
+// "Authorization: Bearer <token>" headers and looks the token up in the
+// access token table. Client credentials tokens authenticate without a user.
+// Unknown tokens are passed on to the next authenticator, so the request is
+// anonymous if none of them knows the token.
+type OAuth2Authenticator struct {
+	Users django.UserStore
+	// AccessTokenTable and ApplicationTable default to the tables of
+	// oauth2_provider.
+	AccessTokenTable string
+	ApplicationTable string
+	// UseChecksum looks tokens up by token_checksum, which
+	// django-oauth-toolkit 3 added.
+	UseChecksum bool
+}
+
+// Authenticate returns the *OAuth2Token as the credentials.
+func (a *OAuth2Authenticator) Authenticate(
+	ctx context.Context, r *http.Request,
+) (django.User, interface{}, error) {
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return nil, nil, nil
+	}
+
+	token, err := a.lookup(ctx, parts[1])
+	if err != nil {
+		// like django-oauth-toolkit an unknown token is left to the other
+		// authenticators, it may be a JWT.
+		if errors.Cause(err) == sql.ErrNoRows {
+			amalgam.LOGGER.Debug("oauth2_unknown_access_token")
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Trace(err)
+	}
+
+	if !time.Now().Before(token.Expires) {
+		return nil, nil, errors.Annotate(
+			django.ErrInvalidCredentials, "access token expired",
+		)
+	}
+
+	if !token.UserID.Valid {
+		return nil, token, nil
+	}
+
+	user, err := activeUser(a.Users.UserByID(ctx, token.UserID.Int64))
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "access token user not found")
+	}
+	return user, token, nil
+}
+
+func (a *OAuth2Authenticator) NeedsCSRF() bool {
+	return false
+}
+
+func (a *OAuth2Authenticator) lookup(
+	ctx context.Context, key string,
+) (*OAuth2Token, error) {
+	tokenTable := a.AccessTokenTable
+	if tokenTable == "" {
+		tokenTable = "oauth2_provider_accesstoken"
+	}
+	applicationTable := a.ApplicationTable
+	if applicationTable == "" {
+		applicationTable = "oauth2_provider_application"
+	}
+
+	where := "t.token = $1"
+	if a.UseChecksum {
+		sum := sha256.Sum256([]byte(key))
+		where = "t.token_checksum = $1"
+		key = hex.EncodeToString(sum[:])
+	}
+
+	token := &OAuth2Token{}
+	query := `
+		SELECT
+			t.id, t.scope, t.expires, t.user_id, t.application_id,
+			a.client_id, a.name AS application_name
+		FROM ` + tokenTable + ` t
+		LEFT JOIN ` + applicationTable + ` a ON a.id = t.application_id
+		WHERE ` + where
+	err := amalgam.QueryIntoStruct(ctx, token, query, key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return token, nil
+}
+
+// RequireScopes only calls fn for requests authenticated with an OAuth2 token
+// that has all of scopes, like django-oauth-toolkit's TokenHasScope.
+func (s *shttp) RequireScopes(fn http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if _, err := s.GetUser(ctx); err != nil {
+			switch errors.Cause(err) {
+			case django.ErrNoUser, sql.ErrNoRows:
+			case django.ErrInvalidCredentials:
+				s.denyAccess(
+					w, r, "invalid_credentials", "Invalid credentials",
+				)
+				return
+			default:
+				s.rejectGuard(w, "user_check_failed", err)
+				return
+			}
+		}
+
+		token, ok := Ctx2OAuth2Token(ctx)
+		if !ok {
+			s.denyAccess(w, r, "login_required", "Login required")
+			return
+		}
+		if !token.HasScopes(scopes...) {
+			s.denyAccess(w, r, "insufficient_scope", "Insufficient scope")
+			return
+		}
+
+		fn(w, r)
+	}
+}
@@ -0,0 +1,269 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amitu/amalgam/django"
+	"github.com/juju/errors"
+)
+
+// oauth2Schema is the part of django-oauth-toolkit's tables the authenticator
+// reads, with a token of each kind. Token 5 only has a checksum, like tokens
+// issued by django-oauth-toolkit 3.
+var oauth2Schema = []string{
+	`CREATE TEMP TABLE oauth2_provider_application (
+		id bigserial PRIMARY KEY,
+		client_id varchar(100) NOT NULL UNIQUE,
+		name varchar(255) NOT NULL
+	)`,
+	`CREATE TEMP TABLE oauth2_provider_accesstoken (
+		id bigserial PRIMARY KEY,
+		token text NOT NULL,
+		token_checksum varchar(64) NOT NULL UNIQUE,
+		scope text NOT NULL,
+		expires timestamptz NOT NULL,
+		user_id bigint,
+		application_id bigint
+	)`,
+	`INSERT INTO oauth2_provider_application (client_id, name)
+	VALUES ('web-client', 'Web')`,
+	`INSERT INTO oauth2_provider_accesstoken (
+		token, token_checksum, scope, expires, user_id, application_id
+	) VALUES
+		('user-token', encode(sha256('user-token'), 'hex'),
+			'read write', now() + interval '1 hour', 42, 1),
+		('expired-token', encode(sha256('expired-token'), 'hex'),
+			'read', now() - interval '1 hour', 42, 1),
+		('client-token', encode(sha256('client-token'), 'hex'),
+			'read', now() + interval '1 hour', NULL, 1),
+		('inactive-token', encode(sha256('inactive-token'), 'hex'),
+			'read', now() + interval '1 hour', 43, 1),
+		('', encode(sha256('checksum-token'), 'hex'),
+			'read', now() + interval '1 hour', 42, NULL)`,
+}
+
+func TestOAuth2Authenticate(t *testing.T) {
+	ctx := testTx(t, oauth2Schema...)
+
+	cases := []struct {
+		name     string
+		checksum bool
+		token    string
+		user     int64
+		client   string
+		err      error
+	}{
+		{"user token", false, "user-token", 42, "web-client", nil},
+		{"client credentials", false, "client-token", 0, "web-client", nil},
+		{"expired", false, "expired-token", 0, "", django.ErrInvalidCredentials},
+		{
+			"inactive user", false, "inactive-token", 0, "",
+			django.ErrInvalidCredentials,
+		},
+		{"unknown token", false, "nope", 0, "", nil},
+		{"checksum", true, "checksum-token", 42, "", nil},
+		{"checksum of a plain token", true, "user-token", 42, "web-client", nil},
+		{"only a checksum", false, "checksum-token", 0, "", nil},
+		{"unknown checksum", true, "nope", 0, "", nil},
+	}
+
+	for _, c := range cases {
+		a := &OAuth2Authenticator{Users: newFakeUsers(), UseChecksum: c.checksum}
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+
+		user, creds, err := a.Authenticate(ctx, r)
+		if errors.Cause(err) != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if (user == nil && c.user != 0) || (user != nil && user.ID() != c.user) {
+			t.Errorf("%s: user = %v", c.name, user)
+		}
+		token, _ := creds.(*OAuth2Token)
+		known := c.err == nil && (c.user != 0 || c.client != "")
+		if known != (token != nil) {
+			t.Errorf("%s: credentials = %v", c.name, creds)
+			continue
+		}
+		if token != nil && token.ClientID.String != c.client {
+			t.Errorf("%s: client_id = %v", c.name, token.ClientID)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "bearer user-token")
+	a := &OAuth2Authenticator{Users: newFakeUsers()}
+	if user, _, err := a.Authenticate(ctx, r); err != nil || user == nil {
+		t.Errorf("lower case bearer: %v, %v", user, err)
+	}
+}
+
+func TestOAuth2OtherSchemes(t *testing.T) {
+	// these are not looked up, so no database is needed.
+	a := &OAuth2Authenticator{Users: newFakeUsers()}
+	for _, header := range []string{
+		"", "Basic dXNlcjpwYXNz", "Token user-token", "Bearer", "Bearer a b",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		if user, creds, err := a.Authenticate(r.Context(), r); user != nil ||
+			creds != nil || err != nil {
+			t.Errorf("%q: %v, %v, %v", header, user, creds, err)
+		}
+	}
+}
+
+func TestOAuth2TokenScopes(t *testing.T) {
+	token := &OAuth2Token{Scope: " read  write\tgroups "}
+	if scopes := token.Scopes(); len(scopes) != 3 || scopes[0] != "read" ||
+		scopes[2] != "groups" {
+		t.Errorf("Scopes() = %q", scopes)
+	}
+
+	cases := []struct {
+		scopes []string
+		has    bool
+	}{
+		{nil, true},
+		{[]string{"read"}, true},
+		{[]string{"read", "groups"}, true},
+		{[]string{"read", "admin"}, false},
+		{[]string{"rea"}, false},
+	}
+	for _, c := range cases {
+		if has := token.HasScopes(c.scopes...); has != c.has {
+			t.Errorf("HasScopes(%q) = %v", c.scopes, has)
+		}
+	}
+
+	if (&OAuth2Token{}).HasScopes("read") {
+		t.Error("token without scopes has read")
+	}
+}
+
+// fixedAuthenticator authenticates every request with user and auth, or fails
+// with err.
+type fixedAuthenticator struct {
+	user django.User
+	auth interface{}
+	err  error
+}
+
+func (a fixedAuthenticator) Authenticate(
+	context.Context, *http.Request,
+) (django.User, interface{}, error) {
+	return a.user, a.auth, a.err
+}
+
+func (a fixedAuthenticator) NeedsCSRF() bool {
+	return false
+}
+
+func TestRequireScopes(t *testing.T) {
+	token := &OAuth2Token{Scope: "read write", Expires: time.Now().Add(time.Hour)}
+	s := &shttp{}
+
+	cases := []struct {
+		name   string
+		by     fixedAuthenticator
+		accept string
+		code   string
+	}{
+		{
+			"has scopes",
+			fixedAuthenticator{user: &fakeUser{id: 42}, auth: token}, "", "",
+		},
+		{"client credentials", fixedAuthenticator{auth: token}, "", ""},
+		{
+			"missing scope", fixedAuthenticator{
+				auth: &OAuth2Token{Scope: "read"},
+			}, "", "insufficient_scope",
+		},
+		{"anonymous", fixedAuthenticator{}, "", "login_required"},
+		{
+			"other credentials", fixedAuthenticator{
+				user: &fakeUser{id: 42}, auth: "api key",
+			}, "", "login_required",
+		},
+		{
+			"invalid token", fixedAuthenticator{
+				err: errors.Trace(django.ErrInvalidCredentials),
+			}, "", "invalid_credentials",
+		},
+		{
+			"lookup failed", fixedAuthenticator{err: errors.New("db down")}, "",
+			"user_check_failed",
+		},
+		{"browser", fixedAuthenticator{}, "text/html", "redirect"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/", nil)
+		r.Header.Set("Accept", c.accept)
+		ru := &requestUser{r: r, authenticators: []Authenticator{c.by}}
+		r = r.WithContext(context.WithValue(r.Context(), KeyRequestUser, ru))
+
+		called := false
+		w := httptest.NewRecorder()
+		s.RequireScopes(func(http.ResponseWriter, *http.Request) {
+			called = true
+		}, "read", "write")(w, r)
+
+		switch c.code {
+		case "":
+			if !called {
+				t.Errorf("%s: rejected with %s", c.name, w.Body)
+			}
+		case "redirect":
+			if called || w.Code != http.StatusFound {
+				t.Errorf("%s: got %d", c.name, w.Code)
+			}
+		case "user_check_failed":
+			if called || !strings.Contains(w.Body.String(), "Oops") {
+				t.Errorf("%s: got %s", c.name, w.Body)
+			}
+		default:
+			if called || !strings.Contains(w.Body.String(), `"`+c.code+`"`) {
+				t.Errorf("%s: got %s, want %s", c.name, w.Body, c.code)
+			}
+		}
+	}
+}
+
+func TestOAuth2UnknownTokenFallsThrough(t *testing.T) {
+	ctx := testTx(t, oauth2Schema...)
+
+	// an unknown bearer token is left to the JWT authenticator after it.
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+validJWT)
+	ru := &requestUser{r: r, authenticators: []Authenticator{
+		&OAuth2Authenticator{Users: newFakeUsers()},
+		&JWTAuthenticator{Users: newFakeUsers(), SigningKey: testSigningKey},
+	}}
+
+	user, err := ru.get(ctx)
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	if user.ID() != 42 {
+		t.Errorf("user = %d", user.ID())
+	}
+	if _, ok := ru.auth.(map[string]interface{}); !ok {
+		t.Errorf("authenticated with %v", ru.auth)
+	}
+
+	// with nobody knowing the token the request is anonymous.
+	r.Header.Set("Authorization", "Bearer nope")
+	ru = &requestUser{r: r, authenticators: []Authenticator{
+		&OAuth2Authenticator{Users: newFakeUsers()},
+	}}
+	if _, err := ru.get(ctx); errors.Cause(err) != django.ErrNoUser {
+		t.Errorf("unknown token: got %v", err)
+	}
+}
@@ -18,18 +18,43 @@ type shttp struct {
 	proxies  map[string]string
 	ctx      context.Context
 	sessions django.SessionStore
+	// csrfExempt holds the patterns passed to CSRFExempt().
+	csrfExempt map[string]bool
+	options    HTTPOptions
 }
 
-func NewHTTPService(
+// HTTPOptions configure a service created by NewCustomHTTPService.
+type HTTPOptions struct {
+	// Authenticators are tried in order to find the user of a request, see
+	// GetUser(). Defaults to just a SessionAuthenticator.
+	Authenticators []Authenticator
+}
+
+func updateHTTPOptionsWithDefault(ho *HTTPOptions) {
+	if len(ho.Authenticators) == 0 {
+		ho.Authenticators = []Authenticator{&SessionAuthenticator{}}
+	}
+}
+
+func NewCustomHTTPService(
 	addr string, ctx context.Context, sessions django.SessionStore,
+	options HTTPOptions,
 ) HTTPService {
+	updateHTTPOptionsWithDefault(&options)
 	h := &shttp{
 		http.NewServeMux(), addr, make(map[string]string), ctx, sessions,
+		make(map[string]bool), options,
 	}
 	h.register()
 	return h
 }
 
+func NewHTTPService(
+	addr string, ctx context.Context, sessions django.SessionStore,
+) HTTPService {
+	return NewCustomHTTPService(addr, ctx, sessions, HTTPOptions{})
+}
+
 func (s *shttp) ListenAndServe(listen string) {
 	http.ListenAndServe(listen, s)
 }
@@ -40,7 +65,7 @@ func (s *shttp) Redirect(w http.ResponseWriter, r *http.Request, url string, cod
 
 func (s *shttp) Register(pattern string, fn http.HandlerFunc) {
 	amalgam.LOGGER.Debug("registering pattern", "pattern", pattern)
-	s.mux.HandleFunc(pattern, fn)
+	s.mux.HandleFunc(pattern, s.csrfProtect(pattern, fn))
 }
 
 func (s *shttp) GetOrCreateTracker(
@@ -6,15 +6,34 @@ import (
 
 	"github.com/amitu/amalgam"
 	"github.com/amitu/amalgam/django"
+	"github.com/amitu/amalgam/django/axes"
+	"github.com/amitu/amalgam/django/otp"
 )
 
 type HTTPService interface {
 	ProxyPass(path, dst string)
 	Register(string, http.HandlerFunc)
+	// CSRFExempt turns off the CSRF check of a registered pattern.
+	CSRFExempt(pattern string)
 	Reject(w http.ResponseWriter, reason map[string][]amalgam.AError)
 	Respond(w http.ResponseWriter, result interface{})
 	ListenAndServe(string)
 	Redirect(w http.ResponseWriter, r *http.Request, url string, code int)
 	GetUser(ctx context.Context) (django.User, error)
+	// LoginRequired, PermissionRequired, RoleRequired and UserPassesTest wrap
+	// handlers passed to Register(), like the django decorators of the same
+	// names.
+	LoginRequired(http.HandlerFunc) http.HandlerFunc
+	PermissionRequired(http.HandlerFunc, ...string) http.HandlerFunc
+	RoleRequired(http.HandlerFunc, ...int64) http.HandlerFunc
+	UserPassesTest(http.HandlerFunc, UserTest) http.HandlerFunc
+	// OTPRequired wraps handlers that need a session verified with 2FA.
+	OTPRequired(http.HandlerFunc, otp.Store) http.HandlerFunc
+	// RequireScopes wraps handlers that need an OAuth2 token with scopes.
+	RequireScopes(http.HandlerFunc, ...string) http.HandlerFunc
+	// LockoutProtected wraps login handlers so requests locked out by
+	// django-axes are rejected with RejectLockedOut().
+	LockoutProtected(http.HandlerFunc, axes.Store) http.HandlerFunc
+	RejectLockedOut(w http.ResponseWriter)
 	GetOrCreateTracker(context.Context, *http.Request) (string, error)
 }
@@ -19,6 +19,9 @@ func statsdInit() {
 }
 
 func Gauge(name string, value int) error {
+	if StatsD == "" {
+		return nil
+	}
 	var msg = []byte(fmt.Sprintf("%s.%s.:%d|g", App, name, value))
 	count, err := statsdConn.Write(msg)
 	if err != nil {
@@ -46,6 +49,9 @@ func Timer(name string, tt time.Duration) error {
 }
 
 func Counter(name string, value int, sampling float64) error {
+	if StatsD == "" {
+		return nil
+	}
 	var msg = []byte(fmt.Sprintf("%s.%s.:%d|c|@%f", App, name, value, sampling))
 	count, err := statsdConn.Write(msg)
 	if err != nil {